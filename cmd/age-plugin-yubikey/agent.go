@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"eagain.net/go/yubage/internal/agent"
+	"golang.org/x/sys/unix"
+)
+
+// agentEnv names the environment variable holding the socket of a
+// running agent. When set, all commands use the cards through the
+// agent.
+const agentEnv = "YUBAGE_AGENT"
+
+func agentSocket(flagValue string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+	if s := os.Getenv(agentEnv); s != "" {
+		return s, nil
+	}
+	return agent.DefaultSocket()
+}
+
+// listenAgent listens on the socket, replacing a stale one left
+// behind by an agent that is no longer running.
+func listenAgent(socket string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(socket), 0700); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", socket); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("agent already running on %s", socket)
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// nobody else gets to talk to the agent
+	old := unix.Umask(0077)
+	defer unix.Umask(old)
+	return net.Listen("unix", socket)
+}
+
+func cmdAgent(_ context.Context, args []string) error {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	socketFlag := fs.String("socket", "", "listen on `PATH`, default $"+agentEnv+" or in $XDG_RUNTIME_DIR")
+	idle := fs.Duration("idle", 15*time.Minute, "close cards after this long unused, 0 to never")
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("agent: unexpected arguments")
+	}
+	socket, err := agentSocket(*socketFlag)
+	if err != nil {
+		return err
+	}
+	if os.Getenv(agentEnv) == socket {
+		// don't talk to ourselves
+		os.Unsetenv(agentEnv)
+	}
+
+	l, err := listenAgent(socket)
+	if err != nil {
+		return fmt.Errorf("agent: %v", err)
+	}
+	defer os.Remove(socket)
+
+	// The agent runs until stopped, no matter what YUBAGE_TIMEOUT
+	// says.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := &agent.Options{
+		Idle:       *idle,
+		NoPINCache: conf.NoPINCache,
+	}
+	server := agent.NewServer(openCards(), opts)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, unix.SIGTERM, unix.SIGHUP)
+	go func() {
+		for sig := range signals {
+			if sig == unix.SIGHUP {
+				// like yubikey-agent, let go of the cards so
+				// others can use them
+				server.Lock()
+				continue
+			}
+			cancel()
+			return
+		}
+	}()
+
+	fmt.Printf("%s=%s; export %s;\n", agentEnv, socket, agentEnv)
+	log.Printf("agent listening on %s", socket)
+	return server.Serve(ctx, l)
+}
+
+func cmdLock(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("lock", flag.ExitOnError)
+	socketFlag := fs.String("socket", "", "agent socket `PATH`, default $"+agentEnv+" or in $XDG_RUNTIME_DIR")
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("lock: unexpected arguments")
+	}
+	socket, err := agentSocket(*socketFlag)
+	if err != nil {
+		return err
+	}
+	return agent.Lock(ctx, socket)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivplug"
+)
+
+// loadBundles reads and verifies the bundle files named in the
+// configuration.
+func loadBundles() ([]*pivplug.Bundle, error) {
+	var bundles []*pivplug.Bundle
+	for _, path := range conf.Bundles {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		b, err := pivplug.ParseBundle(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if _, err := b.Verify(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		bundles = append(bundles, b)
+	}
+	return bundles, nil
+}
+
+// recipientOptions are the plugin options for encryption, with the
+// configured bundles.
+func recipientOptions() (*pivplug.Options, error) {
+	opts := pluginOptions()
+	bundles, err := loadBundles()
+	if err != nil {
+		return nil, err
+	}
+	opts.Bundles = bundles
+	opts.RequireAttestation = conf.RequireAttestation
+	return opts, nil
+}
+
+// bundleRecipient returns the recipient of the bundle named s, or s
+// itself if there is none. opts may be nil.
+func bundleRecipient(opts *pivplug.Options, s string) string {
+	if opts == nil {
+		return s
+	}
+	for _, b := range opts.Bundles {
+		if b.Name == s {
+			return b.Recipient
+		}
+	}
+	return s
+}
+
+func printBundle(b *pivplug.Bundle) {
+	fmt.Printf("# bundle %q: serial %d, slot %02x\n", b.Name, b.Serial, b.Slot)
+	fmt.Printf("# attested by Yubico, PIN policy: %s, touch policy: %s\n", b.PINPolicy, b.TouchPolicy)
+	fmt.Printf("%s\n", b.Recipient)
+}
+
+func cmdBundle(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	serial := fs.Uint("serial", 0, "serial number of the Yubikey to use")
+	slot := fs.Uint("slot", 0x82, "slot of the key")
+	name := fs.String("name", "", "name of the key owner, for those who encrypt to it")
+	output := fs.String("o", "", "output file, default stdout")
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("bundle: unexpected arguments")
+	}
+	if *serial == 0 {
+		return errors.New("bundle: --serial is required")
+	}
+	if *name == "" {
+		return errors.New("bundle: --name is required")
+	}
+	if *slot > 0xff {
+		return fmt.Errorf("bundle: slot out of range: %#x", *slot)
+	}
+
+	cards := openCards()
+	a, err := cards.Attest(uint32(*serial), uint8(*slot))
+	if err != nil {
+		return err
+	}
+	b, err := pivplug.NewBundle(*name, uint8(*slot), a)
+	if err != nil {
+		return err
+	}
+	if b.Serial != uint32(*serial) {
+		return fmt.Errorf("attestation is for Yubikey %d, not %d", b.Serial, *serial)
+	}
+	card, err := cards.Open(uint32(*serial), uint8(*slot))
+	if err != nil {
+		return err
+	}
+	defer card.Close()
+	if b.TouchPolicy != pivcard.TouchPolicyNever {
+		fmt.Fprintln(stderr, "Touch your Yubikey when it blinks.")
+	}
+	if err := b.Sign(ctx, card, readSecret, showMessage); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		_, err := os.Stdout.Write(b.Marshal())
+		return err
+	}
+	return ioutil.WriteFile(*output, b.Marshal(), 0644)
+}
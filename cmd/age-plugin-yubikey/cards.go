@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+
+	"eagain.net/go/yubage/internal/agent"
+	"eagain.net/go/yubage/internal/config"
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivplug"
+)
+
+// emulatorEnv names the environment variable that, when set, makes
+// all commands use a software card emulator with state in the named
+// file, instead of the connected hardware.
+const emulatorEnv = "YUBAGE_EMULATOR"
+
+// configEnv names the environment variable that overrides where the
+// configuration file is read from.
+const configEnv = "YUBAGE_CONFIG"
+
+// conf is the user configuration, loaded at startup.
+var conf = &config.Config{}
+
+func loadConfig() (*config.Config, error) {
+	path := os.Getenv(configEnv)
+	if path == "" {
+		p, err := config.DefaultPath()
+		if err != nil {
+			return nil, err
+		}
+		path = p
+	}
+	return config.Load(path)
+}
+
+func openCards() pivcard.Opener {
+	opts := &pivcard.Options{
+		Readers:       conf.Readers,
+		Names:         conf.Names,
+		ReleaseAgents: conf.ReleaseAgents,
+	}
+	if socket := os.Getenv(agentEnv); socket != "" {
+		return agent.NewOpener(socket)
+	}
+	if path := os.Getenv(emulatorEnv); path != "" {
+		return pivcard.NewEmulator(path, opts)
+	}
+	return pivcard.New(opts)
+}
+
+func pluginOptions() *pivplug.Options {
+	return &pivplug.Options{
+		NoPINCache: conf.NoPINCache,
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"eagain.net/go/yubage/internal/agefile"
+	"eagain.net/go/yubage/internal/pivplug"
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+)
+
+// stringsFlag is a flag that can be given multiple times.
+type stringsFlag []string
+
+var _ flag.Value = (*stringsFlag)(nil)
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// openIO opens the input and output files named in the arguments,
+// defaulting to stdin and stdout. The returned finish function must
+// be called with the result of the operation.
+//
+// The output is written to a temporary file next to it, which finish
+// renames over the output only on success. An existing output file
+// is never truncated, so it may safely be the input file too, under
+// any name.
+func openIO(inputs []string, output string) (io.Reader, io.Writer, func(error) error, error) {
+	var in io.Reader = os.Stdin
+	var inFile *os.File
+	switch len(inputs) {
+	case 0:
+	case 1:
+		f, err := os.Open(inputs[0])
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		in = f
+		inFile = f
+	default:
+		return nil, nil, nil, errors.New("too many arguments")
+	}
+
+	var out io.Writer = os.Stdout
+	var outFile *os.File
+	if output != "" {
+		// Replace the file a symlink points to, not the symlink.
+		if p, err := filepath.EvalSymlinks(output); err == nil {
+			output = p
+		}
+		f, err := createTemp(output)
+		if err != nil {
+			if inFile != nil {
+				_ = inFile.Close()
+			}
+			return nil, nil, nil, err
+		}
+		out = f
+		outFile = f
+	}
+
+	finish := func(err error) error {
+		if inFile != nil {
+			_ = inFile.Close()
+		}
+		if outFile != nil {
+			if closeErr := outFile.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				err = os.Rename(outFile.Name(), output)
+			}
+			if err != nil {
+				_ = os.Remove(outFile.Name())
+			}
+		}
+		return err
+	}
+	return in, out, finish, nil
+}
+
+// createTemp creates a temporary file in the directory of path, to be
+// renamed to path later. It gets the permissions of an existing file
+// at path; a new file is only accessible by the user.
+func createTemp(path string) (*os.File, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		if err := f.Chmod(fi.Mode().Perm()); err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func cmdEncrypt(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	var recipients stringsFlag
+	fs.Var(&recipients, "r", "recipient to encrypt to, can be repeated")
+	output := fs.String("o", "", "output file, default stdout")
+	_ = fs.Parse(args)
+	if len(recipients) == 0 {
+		return errors.New("encrypt: need at least one recipient")
+	}
+
+	opts, err := recipientOptions()
+	if err != nil {
+		return err
+	}
+	pivRecipients, err := parseRecipients(recipients, opts)
+	if err != nil {
+		return err
+	}
+
+	in, out, finish, err := openIO(fs.Args(), *output)
+	if err != nil {
+		return err
+	}
+	return finish(encrypt(in, out, pivRecipients))
+}
+
+func encrypt(in io.Reader, out io.Writer, recipients []*pivplug.PIVRecipient) error {
+	fileKey, err := agefile.NewFileKey()
+	if err != nil {
+		return fmt.Errorf("cannot generate file key: %v", err)
+	}
+	wrapped, err := pivplug.WrapFileKeys(recipients, [][]byte{fileKey})
+	if err != nil {
+		return err
+	}
+	var stanzas []*format.Stanza
+	for _, s := range wrapped {
+		stanzas = append(stanzas, s[0])
+	}
+
+	bufOut := bufio.NewWriter(out)
+	w, err := agefile.Encrypt(bufOut, fileKey, stanzas)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return bufOut.Flush()
+}
+
+// readIdentities parses an identity file, ignoring empty lines and
+// comments.
+func readIdentities(path string) ([]*pivplug.PIVIdentity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var identities []*pivplug.PIVIdentity
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := pivplug.ParsePIVIdentity(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad identity: %v", path, lineNum, err)
+		}
+		identities = append(identities, id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return identities, nil
+}
+
+func cmdDecrypt(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	var identityFiles stringsFlag
+	fs.Var(&identityFiles, "i", "identity file to decrypt with, can be repeated")
+	output := fs.String("o", "", "output file, default stdout")
+	_ = fs.Parse(args)
+	if len(identityFiles) == 0 {
+		return errors.New("decrypt: need at least one identity file")
+	}
+
+	var identities []*pivplug.PIVIdentity
+	for _, path := range identityFiles {
+		ids, err := readIdentities(path)
+		if err != nil {
+			return err
+		}
+		identities = append(identities, ids...)
+	}
+
+	in, out, finish, err := openIO(fs.Args(), *output)
+	if err != nil {
+		return err
+	}
+	return finish(decrypt(ctx, in, out, identities))
+}
+
+func decrypt(ctx context.Context, in io.Reader, out io.Writer, identities []*pivplug.PIVIdentity) error {
+	hdr, payload, err := format.Parse(in)
+	if err != nil {
+		return err
+	}
+	fileKey, err := pivplug.UnwrapFileKey(ctx, openCards(), pluginOptions(), identities, hdr.Recipients, readSecret, showMessage)
+	if err != nil {
+		return err
+	}
+	if err := agefile.VerifyHeader(fileKey, hdr); err != nil {
+		return err
+	}
+	r, err := agefile.Decrypt(payload, fileKey)
+	if err != nil {
+		return err
+	}
+	bufOut := bufio.NewWriter(out)
+	if _, err := io.Copy(bufOut, r); err != nil {
+		return err
+	}
+	return bufOut.Flush()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// chdir changes to dir for the duration of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	orig, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(orig); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestOpenIOSameFile(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	if err := os.Symlink("x.age", "link.age"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		input, output string
+	}{
+		{"same", "x.age", "x.age"},
+		{"relative", "./x.age", "x.age"},
+		{"absolute", filepath.Join(dir, "x.age"), "x.age"},
+		{"symlink input", "link.age", "x.age"},
+		{"symlink output", "x.age", "link.age"},
+		{"hard link", "hard.age", "x.age"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			const content = "original content"
+			if err := ioutil.WriteFile("x.age", []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_ = os.Remove("hard.age")
+			if err := os.Link("x.age", "hard.age"); err != nil {
+				t.Fatal(err)
+			}
+			in, out, finish, err := openIO([]string{tc.input}, tc.output)
+			if err != nil {
+				t.Fatalf("openIO: %v", err)
+			}
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, in); err != nil {
+				t.Fatalf("reading input: %v", err)
+			}
+			buf.WriteString(" and more")
+			if _, err := out.Write(buf.Bytes()); err != nil {
+				t.Fatalf("writing output: %v", err)
+			}
+			if err := finish(nil); err != nil {
+				t.Fatalf("finish: %v", err)
+			}
+			got, err := ioutil.ReadFile("x.age")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g, e := string(got), content+" and more"; g != e {
+				t.Errorf("wrong output: %q != %q", g, e)
+			}
+			if fi, err := os.Lstat("link.age"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("symlink was replaced: %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenIOFailure(t *testing.T) {
+	chdir(t, t.TempDir())
+	const content = "original content"
+	if err := ioutil.WriteFile("x.age", []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, out, finish, err := openIO([]string{"./x.age"}, "x.age")
+	if err != nil {
+		t.Fatalf("openIO: %v", err)
+	}
+	if _, err := out.Write([]byte("partial")); err != nil {
+		t.Fatalf("writing output: %v", err)
+	}
+	errFail := errors.New("failed")
+	if err := finish(errFail); err != errFail {
+		t.Fatalf("finish: %v", err)
+	}
+	got, err := ioutil.ReadFile("x.age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(got), content; g != e {
+		t.Errorf("output was overwritten: %q != %q", g, e)
+	}
+	files, err := ioutil.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "x.age" {
+		t.Errorf("temporary file left behind: %v", files)
+	}
+}
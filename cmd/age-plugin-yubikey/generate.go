@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivplug"
+)
+
+func cmdGenerate(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	serial := fs.Uint("serial", 0, "serial number of the Yubikey to use")
+	slot := fs.Uint("slot", 0x82, "retired key management slot to use, 0x82-0x95")
+	algorithm := fs.String("algorithm", "p256", "key type: p256 or p384")
+	pinPolicy := fs.String("pin-policy", "once", "PIN policy: never, once or always")
+	touchPolicy := fs.String("touch-policy", "always", "touch policy: never, always or cached")
+	name := fs.String("name", "age-plugin-yubikey", "name to store in the certificate")
+	mgmtKeyHex := fs.String("management-key", "", "management key in hex, if not the default")
+	overwrite := fs.Bool("force", false, "overwrite an existing key in the slot")
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("generate: unexpected arguments")
+	}
+	if *serial == 0 {
+		return errors.New("generate: --serial is required")
+	}
+	if *slot > 0xff {
+		return fmt.Errorf("generate: slot out of range: %#x", *slot)
+	}
+
+	opts := &pivcard.KeyOptions{
+		Name:      *name,
+		Overwrite: *overwrite,
+	}
+	var err error
+	if opts.Algorithm, err = pivcard.ParseAlgorithm(*algorithm); err != nil {
+		return err
+	}
+	if opts.PINPolicy, err = pivcard.ParsePINPolicy(*pinPolicy); err != nil {
+		return err
+	}
+	if opts.TouchPolicy, err = pivcard.ParseTouchPolicy(*touchPolicy); err != nil {
+		return err
+	}
+	if *mgmtKeyHex != "" {
+		buf, err := hex.DecodeString(*mgmtKeyHex)
+		if err != nil {
+			return fmt.Errorf("cannot parse management key: %v", err)
+		}
+		var key [24]byte
+		if len(buf) != len(key) {
+			return fmt.Errorf("management key must be %d bytes", len(key))
+		}
+		copy(key[:], buf)
+		opts.ManagementKey = &key
+	}
+
+	if opts.TouchPolicy != pivcard.TouchPolicyNever {
+		fmt.Fprintln(stderr, "Touch your Yubikey when it blinks.")
+	}
+	cards := openCards()
+	recipient, identity, err := pivplug.Generate(cards, uint32(*serial), uint8(*slot), opts, readSecret)
+	if err != nil {
+		return err
+	}
+	printKey(os.Stdout, &pivplug.HardwareKey{
+		Serial:    uint32(*serial),
+		Slot:      uint8(*slot),
+		Name:      *name,
+		Recipient: recipient,
+		Identity:  identity,
+	})
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"eagain.net/go/yubage/internal/pivplug"
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+)
+
+func cmdInspect(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	var identityFiles stringsFlag
+	fs.Var(&identityFiles, "i", "identity file to match against, can be repeated")
+	useCards := fs.Bool("cards", false, "match against keys on connected Yubikeys")
+	_ = fs.Parse(args)
+
+	var identities []*pivplug.PIVIdentity
+	for _, path := range identityFiles {
+		ids, err := readIdentities(path)
+		if err != nil {
+			return err
+		}
+		identities = append(identities, ids...)
+	}
+
+	var keys []*pivplug.HardwareKey
+	if *useCards {
+		cards, err := pivplug.ListKeys(openCards())
+		if err != nil {
+			return err
+		}
+		for _, card := range cards {
+			keys = append(keys, card.Keys...)
+		}
+	}
+
+	in, _, finish, err := openIO(fs.Args(), "")
+	if err != nil {
+		return err
+	}
+	hdr, _, err := format.Parse(in)
+	if err != nil {
+		return finish(err)
+	}
+
+	infos := pivplug.Inspect(hdr.Recipients, identities, keys)
+	for i, info := range infos {
+		if info.Err != nil {
+			fmt.Printf("stanza %d: %s: malformed: %v\n", i, info.Type, info.Err)
+			continue
+		}
+		if info.Tag == "" {
+			fmt.Printf("stanza %d: %s\n", i, info.Type)
+			continue
+		}
+		fmt.Printf("stanza %d: %s tag %s\n", i, info.Type, info.Tag)
+		fmt.Printf("\tephemeral key %s\n", info.EphemeralKeyString())
+		for _, ident := range info.Identities {
+			fmt.Printf("\tidentity: serial %d, slot %02x\n", ident.Serial, ident.Slot)
+		}
+		for _, k := range info.Keys {
+			fmt.Printf("\tconnected Yubikey: serial %d, slot %02x, name %q\n", k.Serial, k.Slot, k.Name)
+		}
+		if len(info.Identities) == 0 && len(info.Keys) == 0 {
+			fmt.Printf("\tno matching key known\n")
+		}
+	}
+	return finish(nil)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"eagain.net/go/yubage/internal/pivplug"
+)
+
+// printKey writes the key in a format usable as an age identity file,
+// with the recipient in a comment.
+func printKey(w io.Writer, k *pivplug.HardwareKey) {
+	fmt.Fprintf(w, "# serial: %d, slot: %02x, name: %q\n", k.Serial, k.Slot, k.Name)
+	fmt.Fprintf(w, "# recipient: %s\n", k.Recipient)
+	fmt.Fprintf(w, "%s\n", k.Identity)
+}
+
+func cmdList(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("list: unexpected arguments")
+	}
+
+	cards, err := pivplug.ListKeys(openCards())
+	if err != nil {
+		return err
+	}
+	for i, card := range cards {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("# Yubikey serial %d in %q\n", card.Serial, card.Reader)
+		if len(card.Keys) == 0 {
+			fmt.Printf("# no age keys\n")
+		}
+		for _, k := range card.Keys {
+			printKey(os.Stdout, k)
+		}
+	}
+	return nil
+}
+
+func cmdIdentity(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("identity", flag.ExitOnError)
+	serial := fs.Uint("serial", 0, "only keys on the Yubikey with this serial number")
+	slot := fs.Uint("slot", 0, "only keys in this slot")
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("identity: unexpected arguments")
+	}
+
+	cards, err := pivplug.ListKeys(openCards())
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, card := range cards {
+		if *serial != 0 && uint(card.Serial) != *serial {
+			continue
+		}
+		for _, k := range card.Keys {
+			if *slot != 0 && uint(k.Slot) != *slot {
+				continue
+			}
+			printKey(os.Stdout, k)
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("no matching age keys found")
+	}
+	return nil
+}
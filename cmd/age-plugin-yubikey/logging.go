@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variables controlling logging.
+const (
+	// logEnv is a comma-separated list of destinations: stderr,
+	// syslog, journald or file:PATH. It overrides the log keyword
+	// of the configuration file.
+	logEnv = "YUBAGE_LOG"
+	// debugEnv turns on debug logging when set to anything but
+	// empty or 0. Debug logs never include secrets.
+	debugEnv = "YUBAGE_DEBUG"
+)
+
+const logTag = "yubage"
+
+// logSpec returns the log destinations asked for, or the empty string
+// for the default.
+func logSpec() string {
+	if spec := os.Getenv(logEnv); spec != "" {
+		return spec
+	}
+	return conf.Log
+}
+
+// openLogs returns a writer for all the destinations in spec. A
+// destination that cannot be opened is complained about on stderr
+// and skipped, as logging is not worth failing for.
+func openLogs(spec string) io.Writer {
+	if spec == "" {
+		return defaultLogs()
+	}
+	var writers []io.Writer
+	for _, dest := range strings.Split(spec, ",") {
+		w, err := openLog(dest)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: cannot log to %s: %v\n", logTag, dest, err)
+			continue
+		}
+		writers = append(writers, w)
+	}
+	if len(writers) == 0 {
+		return stderr
+	}
+	return io.MultiWriter(writers...)
+}
+
+// defaultLogs logs to stderr and, if it is available, syslog.
+//
+// TODO rage v0.5.0 eats plugin stderr, so syslog is where messages
+// from a plugin run can be seen. Stderr is still there when running
+// manually.
+func defaultLogs() io.Writer {
+	w, err := syslog.New(syslog.LOG_DEBUG|syslog.LOG_USER, logTag)
+	if err != nil {
+		// no syslog daemon is normal in containers and such
+		return stderr
+	}
+	return io.MultiWriter(w, stderr)
+}
+
+func openLog(dest string) (io.Writer, error) {
+	switch {
+	case dest == "stderr":
+		return stderr, nil
+	case dest == "syslog":
+		return syslog.New(syslog.LOG_DEBUG|syslog.LOG_USER, logTag)
+	case dest == "journald":
+		return newJournald()
+	case strings.HasPrefix(dest, "file:"):
+		return os.OpenFile(strings.TrimPrefix(dest, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	default:
+		return nil, fmt.Errorf("unknown log destination %q", dest)
+	}
+}
+
+func debugEnabled() bool {
+	v := os.Getenv(debugEnv)
+	if v == "" {
+		return false
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		// AGEDEBUG style values like "plugin" mean yes
+		return true
+	}
+	return on
+}
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldWriter sends each write as one entry to the systemd
+// journal, with its native protocol.
+type journaldWriter struct {
+	conn *net.UnixConn
+}
+
+func newJournald() (*journaldWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldWriter{conn: conn}, nil
+}
+
+func (j *journaldWriter) Write(p []byte) (int, error) {
+	msg := bytes.TrimSuffix(p, []byte("\n"))
+	buf := new(bytes.Buffer)
+	buf.WriteString("SYSLOG_IDENTIFIER=" + logTag + "\n")
+	buf.WriteString("PRIORITY=7\n")
+	// multi-line values need the length-prefixed form
+	buf.WriteString("MESSAGE\n")
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(msg)))
+	buf.Write(msg)
+	buf.WriteString("\n")
+	if _, err := j.conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
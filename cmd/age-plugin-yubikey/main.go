@@ -1,16 +1,19 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
-	"log/syslog"
 	"os"
 	"os/signal"
+	"sort"
+	"time"
 
 	"eagain.net/go/yubage/internal/ageplugin"
-	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/debuglog"
 	"eagain.net/go/yubage/internal/pivplug"
 	"golang.org/x/sys/unix"
 )
@@ -29,44 +32,157 @@ func (i *ignoreEPIPEWriter) Write(p []byte) (int, error) {
 	return n, err
 }
 
+// commands are the subcommands for interactive use, as opposed to
+// being run as an age plugin.
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"agent":    cmdAgent,
+	"bundle":   cmdBundle,
+	"decrypt":  cmdDecrypt,
+	"encrypt":  cmdEncrypt,
+	"generate": cmdGenerate,
+	"identity": cmdIdentity,
+	"inspect":  cmdInspect,
+	"list":     cmdList,
+	"lock":     cmdLock,
+	"replay":   cmdReplay,
+	"rewrap":   cmdRewrap,
+	"unblock":  cmdUnblock,
+	"verify":   cmdVerify,
+}
+
+// timeoutEnv names the environment variable that limits how long a
+// run may take, as a Go duration like "2m". This is meant for
+// scripts, where a missing touch should not hang forever.
+const timeoutEnv = "YUBAGE_TIMEOUT"
+
+func timeoutContext() (context.Context, context.CancelFunc, error) {
+	ctx := context.Background()
+	s := os.Getenv(timeoutEnv)
+	if s == "" {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot parse %s: %v", timeoutEnv, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, d)
+	return ctx, cancel, nil
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "  %s --age-plugin=PROTOCOL\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "  %s COMMAND [FLAGS]\n", os.Args[0])
+	fmt.Fprintf(flag.CommandLine.Output(), "\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s\n", name)
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
 func main() {
+	os.Exit(run())
+}
+
+// run is main without os.Exit, so deferred calls run before exiting.
+func run() int {
 	log.SetFlags(0)
 	log.SetPrefix("yubage: ")
+	signal.Ignore(unix.SIGPIPE)
 
-	// TODO rage v0.5.0 eats plugin stderr, workaround by logging to
-	// syslog. I wish I could just dup2 something over stderr, instead
-	// of having to talk syslog protocol.
-	logWriter, err := syslog.New(syslog.LOG_DEBUG|syslog.LOG_USER, "yubage")
-	if err != nil {
-		log.Fatalf("cannot open syslog: %v", err)
+	var agePlugin string
+	flag.StringVar(&agePlugin, "age-plugin", "", "age plugin protocol to speak")
+	transcriptPath := flag.String("transcript", os.Getenv(transcriptEnv), "record the plugin protocol in `FILE`")
+	unredacted := flag.Bool("transcript-unredacted", os.Getenv(transcriptUnredactedEnv) != "", "include file keys and PINs in the transcript")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if os.Getenv(emulatorEnv) != "" {
+		// X25519 only works with the emulator, and its formats
+		// may still change.
+		pivplug.EnableExperimentalKeys()
 	}
-	// logging to both so stderr is still there when running manually
-	signal.Ignore(unix.SIGPIPE)
-	log.SetOutput(io.MultiWriter(logWriter, &ignoreEPIPEWriter{os.Stderr}))
+
+	// The configuration can say where to log, so errors loading it
+	// are reported only after the logs are open.
+	c, configErr := loadConfig()
+	if configErr == nil {
+		conf = c
+	}
+	log.SetOutput(openLogs(logSpec()))
+	debuglog.SetEnabled(debugEnabled())
 	defer func() {
 		if err := recover(); err != nil {
 			log.Printf("PANIC: %v", err)
 			panic(err)
 		}
 	}()
+	if configErr != nil {
+		log.Print(configErr)
+		return 1
+	}
 
-	var agePlugin string
-	flag.StringVar(&agePlugin, "age-plugin", "", "age plugin protocol to speak")
+	ctx, cancel, err := timeoutContext()
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer cancel()
 
-	flag.Parse()
+	if agePlugin == "" {
+		if flag.NArg() == 0 {
+			flag.Usage()
+			return 2
+		}
+		cmd, ok := commands[flag.Arg(0)]
+		if !ok {
+			log.Printf("unknown command: %q", flag.Arg(0))
+			return 1
+		}
+		if err := cmd(ctx, flag.Args()[1:]); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
 
 	conn := ageplugin.New(os.Stdin, os.Stdout)
-	switch agePlugin {
-	case "identity-v1":
-		cards := pivcard.New()
-		if err := pivplug.Identity(cards, conn); err != nil {
-			log.Fatal(err)
+	if *transcriptPath != "" {
+		f, err := os.OpenFile(*transcriptPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Printf("cannot open transcript: %v", err)
+			return 1
 		}
+		defer f.Close()
+		conn.SetTranscript(ageplugin.NewTranscript(f, *unredacted))
+	}
+	if err := runPlugin(ctx, agePlugin, conn); err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+func runPlugin(ctx context.Context, mode string, conn *ageplugin.Conn) error {
+	switch mode {
+	case "identity-v1":
+		cards := openCards()
+		return pivplug.Identity(ctx, cards, pluginOptions(), conn)
 	case "recipient-v1":
-		if err := pivplug.Recipient(conn); err != nil {
-			log.Fatal(err)
+		opts, err := recipientOptions()
+		if err != nil {
+			return err
 		}
+		return pivplug.Recipient(ctx, opts, conn)
 	default:
-		log.Fatal("unknown plugin")
+		return errors.New("unknown plugin")
 	}
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// stderr is where interactive subcommands talk to the user.
+var stderr io.Writer = &ignoreEPIPEWriter{os.Stderr}
+
+// showMessage tells the user something on the controlling terminal,
+// or stderr if there is none.
+func showMessage(msg string) error {
+	var out io.Writer = stderr
+	if tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0); err == nil {
+		defer tty.Close()
+		out = tty
+	}
+	_, err := fmt.Fprintln(out, msg)
+	return err
+}
+
+// readSecret prompts for a line of input on the controlling terminal,
+// with echo disabled. Without a terminal, it uses stderr and stdin.
+func readSecret(prompt string) (string, error) {
+	in, out := os.Stdin, stderr
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		in, out = tty, tty
+	}
+	fmt.Fprintf(out, "%s: ", prompt)
+	fd := int(in.Fd())
+	if orig, err := unix.IoctlGetTermios(fd, ioctlReadTermios); err == nil {
+		noEcho := *orig
+		noEcho.Lflag &^= unix.ECHO
+		if err := unix.IoctlSetTermios(fd, ioctlWriteTermios, &noEcho); err != nil {
+			return "", fmt.Errorf("cannot disable terminal echo: %v", err)
+		}
+		defer func() {
+			_ = unix.IoctlSetTermios(fd, ioctlWriteTermios, orig)
+			fmt.Fprintln(out)
+		}()
+	}
+	// Read one byte at a time, to never consume input past the end
+	// of line.
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := in.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("cannot read secret: %v", noEOF(err))
+		}
+	}
+	secret := strings.TrimSuffix(string(line), "\r")
+	if secret == "" {
+		return "", errors.New("no secret entered")
+	}
+	return secret, nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
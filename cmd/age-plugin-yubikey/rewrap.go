@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"eagain.net/go/yubage/internal/agefile"
+	"eagain.net/go/yubage/internal/pivplug"
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+)
+
+// parseRecipients expands aliases and bundle names. Recipients that
+// opts refuses are an error; opts may be nil.
+func parseRecipients(recipients []string, opts *pivplug.Options) ([]*pivplug.PIVRecipient, error) {
+	var result []*pivplug.PIVRecipient
+	for _, s := range recipients {
+		r, err := pivplug.ParsePIVRecipient(bundleRecipient(opts, conf.Recipient(s)))
+		if err != nil {
+			return nil, fmt.Errorf("bad recipient %q: %v", s, err)
+		}
+		if err := opts.CheckRecipient(r); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func cmdRewrap(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rewrap", flag.ExitOnError)
+	var identityFiles, add, remove stringsFlag
+	fs.Var(&identityFiles, "i", "identity file to decrypt the file key with, can be repeated")
+	fs.Var(&add, "r", "recipient to add, can be repeated")
+	fs.Var(&remove, "remove", "recipient to remove, can be repeated; the file key stays the same, so this does not revoke access")
+	output := fs.String("o", "", "output file, default stdout")
+	_ = fs.Parse(args)
+	if len(identityFiles) == 0 {
+		return errors.New("rewrap: need at least one identity file")
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		return errors.New("rewrap: nothing to do")
+	}
+
+	var identities []*pivplug.PIVIdentity
+	for _, path := range identityFiles {
+		ids, err := readIdentities(path)
+		if err != nil {
+			return err
+		}
+		identities = append(identities, ids...)
+	}
+	opts, err := recipientOptions()
+	if err != nil {
+		return err
+	}
+	addRecipients, err := parseRecipients(add, opts)
+	if err != nil {
+		return err
+	}
+	removeRecipients, err := parseRecipients(remove, nil)
+	if err != nil {
+		return err
+	}
+
+	in, out, finish, err := openIO(fs.Args(), *output)
+	if err != nil {
+		return err
+	}
+	return finish(rewrap(ctx, in, out, identities, addRecipients, removeRecipients))
+}
+
+func rewrap(ctx context.Context, in io.Reader, out io.Writer, identities []*pivplug.PIVIdentity, add, remove []*pivplug.PIVRecipient) error {
+	hdr, payload, err := format.Parse(in)
+	if err != nil {
+		return err
+	}
+	fileKey, err := pivplug.UnwrapFileKey(ctx, openCards(), pluginOptions(), identities, hdr.Recipients, readSecret, showMessage)
+	if err != nil {
+		return err
+	}
+	if err := agefile.VerifyHeader(fileKey, hdr); err != nil {
+		return err
+	}
+	stanzas, err := pivplug.Rewrap(hdr.Recipients, fileKey, add, remove)
+	if err != nil {
+		return err
+	}
+
+	bufOut := bufio.NewWriter(out)
+	if err := agefile.WriteHeader(bufOut, fileKey, stanzas); err != nil {
+		return err
+	}
+	// The payload is encrypted with a key derived from the file key
+	// and its own nonce, so it stays valid as is.
+	if _, err := io.Copy(bufOut, payload); err != nil {
+		return err
+	}
+	return bufOut.Flush()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivplug"
+)
+
+func TestRewrapInPlace(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	t.Setenv(agentEnv, "")
+	t.Setenv(emulatorEnv, filepath.Join(dir, "emulator.json"))
+
+	opts := &pivcard.KeyOptions{
+		PINPolicy:   pivcard.PINPolicyNever,
+		TouchPolicy: pivcard.TouchPolicyNever,
+	}
+	prompt := func(string) (string, error) {
+		t.Error("unexpected prompt")
+		return "", nil
+	}
+	oldRecipient, oldIdentity, err := pivplug.Generate(openCards(), pivcard.EmulatorSerial, 0x82, opts, prompt)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	newRecipient, newIdentity, err := pivplug.Generate(openCards(), pivcard.EmulatorSerial, 0x83, opts, prompt)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	for path, identity := range map[string]string{"old.identity": oldIdentity, "new.identity": newIdentity} {
+		if err := ioutil.WriteFile(path, []byte(identity+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const content = "secret"
+	if err := ioutil.WriteFile("secret.txt", []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := cmdEncrypt(ctx, []string{"-r", oldRecipient, "-o", "x.age", "secret.txt"}); err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if err := cmdRewrap(ctx, []string{"-i", "old.identity", "-r", newRecipient, "--remove", oldRecipient, "-o", "x.age", "./x.age"}); err != nil {
+		t.Fatalf("rewrap: %v", err)
+	}
+	if err := cmdDecrypt(ctx, []string{"-i", "new.identity", "-o", "out.txt", "x.age"}); err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	got, err := ioutil.ReadFile("out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(got), content; g != e {
+		t.Errorf("wrong content: %q != %q", g, e)
+	}
+	if err := cmdDecrypt(ctx, []string{"-i", "old.identity", "-o", "out.txt", "x.age"}); err == nil {
+		t.Errorf("removed recipient could still decrypt")
+	}
+}
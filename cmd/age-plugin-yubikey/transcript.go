@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"eagain.net/go/yubage/internal/ageplugin"
+)
+
+// Environment variables for recording transcripts in plugin mode,
+// where rage decides the command line.
+const (
+	transcriptEnv           = "YUBAGE_TRANSCRIPT"
+	transcriptUnredactedEnv = "YUBAGE_TRANSCRIPT_UNREDACTED"
+)
+
+// transcriptMode guesses the plugin mode from what the host sent.
+func transcriptMode(entries []*ageplugin.TranscriptEntry) (string, error) {
+	for _, e := range entries {
+		if e.Dir != ageplugin.TranscriptIn {
+			continue
+		}
+		switch e.Type {
+		case "add-identity", "recipient-stanza":
+			return "identity-v1", nil
+		case "add-recipient", "wrap-file-key":
+			return "recipient-v1", nil
+		}
+	}
+	return "", errors.New("cannot tell plugin mode from transcript")
+}
+
+func cmdReplay(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	mode := fs.String("mode", "", "plugin protocol, if not clear from the transcript")
+	pin := fs.String("pin", "", "PIN to answer redacted PIN requests with")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("replay: need one transcript file")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	recorded, err := ageplugin.ReadTranscript(f)
+	if err != nil {
+		return err
+	}
+	if *mode == "" {
+		if *mode, err = transcriptMode(recorded); err != nil {
+			return err
+		}
+	}
+
+	input, err := ageplugin.ReplayInput(recorded, func(e *ageplugin.TranscriptEntry) []byte {
+		if e.Type == "ok" && *pin != "" {
+			return []byte(*pin)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The replay transcript goes to stdout, and differences to
+	// the recording to stderr.
+	conn := ageplugin.New(bytes.NewReader(input), new(bytes.Buffer))
+	replayed := new(bytes.Buffer)
+	conn.SetTranscript(ageplugin.NewTranscript(replayed, true))
+	runErr := runPlugin(ctx, *mode, conn)
+	if _, err := os.Stdout.Write(replayed.Bytes()); err != nil {
+		return err
+	}
+	entries, err := ageplugin.ReadTranscript(replayed)
+	if err != nil {
+		return err
+	}
+	if diff := diffOutput(recorded, entries); diff != "" {
+		fmt.Fprintf(stderr, "replay differs from recording: %s\n", diff)
+	}
+	return runErr
+}
+
+// diffOutput compares the stanza types the plugin wrote. Arguments
+// and bodies are expected to differ, with random ephemeral keys and
+// different cards.
+func diffOutput(recorded, replayed []*ageplugin.TranscriptEntry) string {
+	outTypes := func(entries []*ageplugin.TranscriptEntry) []string {
+		var types []string
+		for _, e := range entries {
+			if e.Dir == ageplugin.TranscriptOut {
+				types = append(types, e.Type)
+			}
+		}
+		return types
+	}
+	want := outTypes(recorded)
+	got := outTypes(replayed)
+	for i := 0; i < len(want) || i < len(got); i++ {
+		switch {
+		case i >= len(got):
+			return fmt.Sprintf("stanza %d: recorded %q, replay ended", i, want[i])
+		case i >= len(want):
+			return fmt.Sprintf("stanza %d: recording ended, replay wrote %q", i, got[i])
+		case got[i] != want[i]:
+			return fmt.Sprintf("stanza %d: recorded %q, replay wrote %q", i, want[i], got[i])
+		}
+	}
+	return ""
+}
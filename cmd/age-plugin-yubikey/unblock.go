@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+)
+
+func cmdUnblock(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("unblock", flag.ExitOnError)
+	serial := fs.Uint("serial", 0, "serial number of the Yubikey to unblock")
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("unblock: unexpected arguments")
+	}
+	if *serial == 0 {
+		return errors.New("unblock: --serial is required")
+	}
+
+	puk, err := readSecret(fmt.Sprintf("Enter PUK for Yubikey with serial %d", *serial))
+	if err != nil {
+		return err
+	}
+	newPIN, err := readSecret("Enter new PIN")
+	if err != nil {
+		return err
+	}
+	again, err := readSecret("Enter new PIN again")
+	if err != nil {
+		return err
+	}
+	if again != newPIN {
+		return errors.New("unblock: PINs do not match")
+	}
+	if err := openCards().Unblock(uint32(*serial), puk, newPIN); err != nil {
+		return err
+	}
+	fmt.Fprintln(stderr, "PIN changed.")
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivplug"
+)
+
+func cmdVerify(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	serial := fs.Uint("serial", 0, "get the attestation from the Yubikey with this serial number")
+	slot := fs.Uint("slot", 0x82, "slot of the key to attest, with --serial")
+	recipient := fs.String("r", "", "recipient the attestation must be for")
+	output := fs.String("o", "", "save the attestation to `FILE`, with --serial")
+	_ = fs.Parse(args)
+	if *slot > 0xff {
+		return fmt.Errorf("verify: slot out of range: %#x", *slot)
+	}
+
+	var a *pivcard.Attestation
+	switch {
+	case *serial != 0:
+		if fs.NArg() != 0 {
+			return errors.New("verify: unexpected arguments with --serial")
+		}
+		var err error
+		a, err = openCards().Attest(uint32(*serial), uint8(*slot))
+		if err != nil {
+			return err
+		}
+		if *output != "" {
+			if err := ioutil.WriteFile(*output, a.MarshalPEM(), 0644); err != nil {
+				return err
+			}
+		}
+
+	case fs.NArg() == 1:
+		if *output != "" {
+			return errors.New("verify: -o needs --serial")
+		}
+		data, err := ioutil.ReadFile(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		b, err := pivplug.ParseBundle(data)
+		if err == nil {
+			return verifyBundle(b, *recipient)
+		}
+		if err != pivplug.ErrNotBundle {
+			return fmt.Errorf("%s: %v", fs.Arg(0), err)
+		}
+		a, err = pivcard.ParseAttestation(data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fs.Arg(0), err)
+		}
+
+	default:
+		return errors.New("verify: need --serial or one attestation or bundle file")
+	}
+
+	var k *pivcard.AttestedKey
+	if *recipient != "" {
+		r, err := pivplug.ParsePIVRecipient(conf.Recipient(*recipient))
+		if err != nil {
+			return fmt.Errorf("bad recipient %q: %v", *recipient, err)
+		}
+		if k, err = pivplug.VerifyAttestation(r, a); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if k, err = a.Verify(); err != nil {
+			return err
+		}
+	}
+	if *serial != 0 && k.Serial != uint32(*serial) {
+		return fmt.Errorf("attestation is for Yubikey %d, not %d", k.Serial, *serial)
+	}
+	attested, err := pivplug.AttestedRecipient(k)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# attested by Yubico: serial %d, firmware %s\n", k.Serial, k.Firmware)
+	fmt.Printf("# PIN policy: %s, touch policy: %s\n", k.PINPolicy, k.TouchPolicy)
+	fmt.Printf("%s\n", attested)
+	return nil
+}
+
+func verifyBundle(b *pivplug.Bundle, recipient string) error {
+	r, err := b.Verify()
+	if err != nil {
+		return err
+	}
+	if recipient != "" {
+		want, err := pivplug.ParsePIVRecipient(conf.Recipient(recipient))
+		if err != nil {
+			return fmt.Errorf("bad recipient %q: %v", recipient, err)
+		}
+		if !bytes.Equal(want.Compressed, r.Compressed) {
+			return errors.New("bundle is for a different key")
+		}
+	}
+	printBundle(b)
+	return nil
+}
@@ -37,7 +37,5 @@ in mkShell {
     pcsclite
     pkg-config
     go
-
-    killall
   ];
 }
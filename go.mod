@@ -1,6 +1,6 @@
 module eagain.net/go/yubage
 
-go 1.15
+go 1.20
 
 require (
 	eagain.net/go/bech32 v0.0.1
@@ -0,0 +1,136 @@
+// Package agefile reads and writes complete age v1 files, with the
+// header MAC and the STREAM encrypted payload.
+//
+// Wrapping and unwrapping the file key is left to the caller.
+package agefile
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// FileKeySize is the size of age file keys.
+	FileKeySize = 16
+
+	payloadNonceSize = 16
+)
+
+// NewFileKey returns a new random file key.
+func NewFileKey() ([]byte, error) {
+	key := make([]byte, FileKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func hkdfKey(fileKey []byte, salt []byte, label string) ([]byte, error) {
+	h := hkdf.New(sha256.New, fileKey, salt, []byte(label))
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// HeaderMAC computes the MAC of the header, authenticated by the file
+// key. The MAC field of hdr is ignored.
+func HeaderMAC(fileKey []byte, hdr *format.Header) ([]byte, error) {
+	macKey, err := hkdfKey(fileKey, nil, "header")
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, macKey)
+	if err := hdr.MarshalWithoutMAC(h); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// VerifyHeader checks the MAC of hdr against the file key.
+func VerifyHeader(fileKey []byte, hdr *format.Header) error {
+	mac, err := HeaderMAC(fileKey, hdr)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, hdr.MAC) {
+		return errors.New("bad header MAC")
+	}
+	return nil
+}
+
+// WriteHeader writes a header holding the stanzas to dst, with the
+// MAC computed from the file key.
+func WriteHeader(dst io.Writer, fileKey []byte, stanzas []*format.Stanza) error {
+	hdr := &format.Header{
+		Recipients: stanzas,
+	}
+	mac, err := HeaderMAC(fileKey, hdr)
+	if err != nil {
+		return fmt.Errorf("cannot compute header MAC: %v", err)
+	}
+	hdr.MAC = mac
+	if err := hdr.Marshal(dst); err != nil {
+		return fmt.Errorf("cannot write header: %v", err)
+	}
+	return nil
+}
+
+// Encrypt writes the header to dst and returns a writer for the
+// plaintext. The caller must Close the returned writer to finish the
+// file.
+func Encrypt(dst io.Writer, fileKey []byte, stanzas []*format.Stanza) (io.WriteCloser, error) {
+	if err := WriteHeader(dst, fileKey, stanzas); err != nil {
+		return nil, err
+	}
+	return EncryptPayload(dst, fileKey)
+}
+
+// EncryptPayload writes the payload nonce to dst and returns a writer
+// for the plaintext. The caller must Close the returned writer to
+// finish the file.
+func EncryptPayload(dst io.Writer, fileKey []byte) (io.WriteCloser, error) {
+	nonce := make([]byte, payloadNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(nonce); err != nil {
+		return nil, err
+	}
+	key, err := hkdfKey(fileKey, nonce, "payload")
+	if err != nil {
+		return nil, err
+	}
+	return NewWriter(key, dst)
+}
+
+// Decrypt returns a reader for the plaintext of the payload, which
+// starts right after the header. The header MAC must already be
+// verified.
+func Decrypt(payload io.Reader, fileKey []byte) (io.Reader, error) {
+	nonce := make([]byte, payloadNonceSize)
+	if _, err := io.ReadFull(payload, nonce); err != nil {
+		return nil, fmt.Errorf("cannot read payload nonce: %w", noEOF(err))
+	}
+	key, err := hkdfKey(fileKey, nonce, "payload")
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(key, payload)
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package agefile_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"eagain.net/go/yubage/internal/agefile"
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+)
+
+func TestRoundtrip(t *testing.T) {
+	for _, size := range []int{
+		0,
+		1,
+		agefile.ChunkSize - 1,
+		agefile.ChunkSize,
+		agefile.ChunkSize + 1,
+		2 * agefile.ChunkSize,
+		2*agefile.ChunkSize + 1000,
+	} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			plaintext := make([]byte, size)
+			if _, err := rand.Read(plaintext); err != nil {
+				t.Fatal(err)
+			}
+			fileKey, err := agefile.NewFileKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stanzas := []*format.Stanza{
+				{Type: "test", Args: []string{"arg"}, Body: []byte("body")},
+			}
+
+			buf := new(bytes.Buffer)
+			w, err := agefile.Encrypt(buf, fileKey, stanzas)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			if _, err := w.Write(plaintext); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			hdr, payload, err := format.Parse(buf)
+			if err != nil {
+				t.Fatalf("format.Parse: %v", err)
+			}
+			if err := agefile.VerifyHeader(fileKey, hdr); err != nil {
+				t.Fatalf("VerifyHeader: %v", err)
+			}
+			r, err := agefile.Decrypt(payload, fileKey)
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("read plaintext: %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Errorf("plaintext mismatch")
+			}
+		})
+	}
+}
+
+func TestVerifyHeaderWrongKey(t *testing.T) {
+	fileKey, err := agefile.NewFileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	stanzas := []*format.Stanza{
+		{Type: "test", Body: []byte("body")},
+	}
+	if err := agefile.WriteHeader(buf, fileKey, stanzas); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	hdr, _, err := format.Parse(buf)
+	if err != nil {
+		t.Fatalf("format.Parse: %v", err)
+	}
+	otherKey, err := agefile.NewFileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := agefile.VerifyHeader(otherKey, hdr); err == nil {
+		t.Error("expected MAC failure")
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	fileKey, err := agefile.NewFileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	w, err := agefile.EncryptPayload(buf, fileKey)
+	if err != nil {
+		t.Fatalf("EncryptPayload: %v", err)
+	}
+	if _, err := w.Write(make([]byte, agefile.ChunkSize+1)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// drop the last chunk
+	truncated := buf.Bytes()[:buf.Len()-(1+16)]
+	r, err := agefile.Decrypt(bytes.NewReader(truncated), fileKey)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expected error for truncated payload")
+	}
+}
@@ -0,0 +1,210 @@
+package agefile
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ChunkSize is the size of plaintext chunks in the STREAM payload.
+const ChunkSize = 64 * 1024
+
+// tagSize is the size of the Poly1305 authentication tag on each
+// chunk.
+const tagSize = 16
+
+const encChunkSize = ChunkSize + tagSize
+
+// nonce is the STREAM nonce, an 11-byte big-endian counter followed
+// by a flag byte set for the last chunk.
+type nonce [chacha20poly1305.NonceSize]byte
+
+func (n *nonce) setLast() {
+	n[len(n)-1] = 0x01
+}
+
+func (n *nonce) isZero() bool {
+	return *n == nonce{}
+}
+
+func (n *nonce) inc() {
+	for i := len(n) - 2; i >= 0; i-- {
+		n[i]++
+		if n[i] != 0 {
+			return
+		}
+	}
+	// 2^88 chunks is more than anyone will ever write
+	panic("agefile: STREAM nonce overflow")
+}
+
+// Writer encrypts a STREAM payload. Close must be called to write
+// the last chunk.
+type Writer struct {
+	aead  cipher.AEAD
+	dst   io.Writer
+	nonce nonce
+	buf   []byte
+	err   error
+}
+
+func NewWriter(key []byte, dst io.Writer) (*Writer, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		aead: aead,
+		dst:  dst,
+		buf:  make([]byte, 0, encChunkSize),
+	}
+	return w, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	total := len(p)
+	for len(p) > 0 {
+		// Only flush a full chunk once more data arrives, as
+		// the last chunk has to be marked as such.
+		if len(w.buf) == ChunkSize {
+			if err := w.flush(false); err != nil {
+				w.err = err
+				return total - len(p), err
+			}
+		}
+		n := ChunkSize - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (w *Writer) flush(last bool) error {
+	if last {
+		w.nonce.setLast()
+	}
+	w.buf = w.aead.Seal(w.buf[:0], w.nonce[:], w.buf, nil)
+	if _, err := w.dst.Write(w.buf); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.nonce.inc()
+	return nil
+}
+
+// Close writes the last chunk. It does not close the underlying
+// writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.flush(true); err != nil {
+		w.err = err
+		return err
+	}
+	w.err = errors.New("agefile: write after close")
+	return nil
+}
+
+// Reader decrypts a STREAM payload.
+type Reader struct {
+	aead  cipher.AEAD
+	src   io.Reader
+	nonce nonce
+	buf   []byte
+	out   []byte
+	plain []byte
+	last  bool
+	err   error
+}
+
+func NewReader(key []byte, src io.Reader) (*Reader, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{
+		aead: aead,
+		src:  src,
+		buf:  make([]byte, encChunkSize),
+		out:  make([]byte, 0, ChunkSize),
+	}
+	return r, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.last {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *Reader) readChunk() error {
+	n, err := io.ReadFull(r.src, r.buf)
+	switch {
+	case err == io.EOF:
+		return io.ErrUnexpectedEOF
+	case err == io.ErrUnexpectedEOF:
+		// short chunk, has to be the last one
+		return r.open(r.buf[:n], true)
+	case err != nil:
+		return err
+	}
+
+	// A full chunk can be the last one, only trial decryption
+	// tells.
+	if err := r.open(r.buf, false); err == nil {
+		return nil
+	}
+	if err := r.open(r.buf, true); err != nil {
+		return err
+	}
+	var extra [1]byte
+	if n, _ := io.ReadFull(r.src, extra[:]); n != 0 {
+		return errors.New("trailing data after end of encrypted file")
+	}
+	return nil
+}
+
+func (r *Reader) open(chunk []byte, last bool) error {
+	if len(chunk) < r.aead.Overhead() {
+		return io.ErrUnexpectedEOF
+	}
+	if last && len(chunk) == r.aead.Overhead() && !r.nonce.isZero() {
+		return errors.New("last chunk is empty")
+	}
+	n := r.nonce
+	if last {
+		n.setLast()
+	}
+	// Not decrypting in place, failed trial decryption would
+	// clobber the ciphertext.
+	plain, err := r.aead.Open(r.out[:0], n[:], chunk, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt and authenticate payload chunk: %v", err)
+	}
+	r.nonce.inc()
+	r.plain = plain
+	r.last = last
+	return nil
+}
@@ -0,0 +1,148 @@
+// Package agent keeps PIV cards open in a long-running process, so
+// the PIN policy "once" lasts across many runs of the plugin. The
+// agent never remembers PINs itself.
+//
+// Clients talk to the agent over a Unix socket, one operation per
+// connection, with JSON messages. Only clients of the same user are
+// served. The client sends a request, and
+// the agent answers with any number of prompt and notify messages
+// before a final result. A prompt must be answered before the agent
+// continues.
+package agent
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"eagain.net/go/yubage/internal/debuglog"
+	"eagain.net/go/yubage/internal/pivcard"
+)
+
+func debugf(format string, args ...interface{}) {
+	debuglog.Printf("agent", format, args...)
+}
+
+// Operations in requests.
+const (
+	opOpen      = "open"
+	opSharedKey = "shared-key"
+	opList      = "list"
+	opGenerate  = "generate"
+	opLock      = "lock"
+	opRetries   = "retries"
+	opUnblock   = "unblock"
+	opAttest    = "attest"
+	opSign      = "sign"
+)
+
+// Kinds of messages from the agent.
+const (
+	kindPrompt = "prompt"
+	kindNotify = "notify"
+	kindResult = "result"
+)
+
+type request struct {
+	Op     string `json:"op"`
+	Serial uint32 `json:"serial,omitempty"`
+	Slot   uint8  `json:"slot,omitempty"`
+	// Peer is the other side of the key agreement.
+	Peer       *wireKey            `json:"peer,omitempty"`
+	Digest     []byte              `json:"digest,omitempty"`
+	KeyOptions *pivcard.KeyOptions `json:"keyOptions,omitempty"`
+	PUK        string              `json:"puk,omitempty"`
+	NewPIN     string              `json:"newPIN,omitempty"`
+}
+
+// answer replies to a prompt.
+type answer struct {
+	Answer string `json:"answer"`
+	// Error is set if the client could not get an answer.
+	Error string `json:"error,omitempty"`
+}
+
+type message struct {
+	Kind string `json:"kind"`
+	// Text is the prompt or notification.
+	Text string `json:"text,omitempty"`
+
+	Error    string            `json:"error,omitempty"`
+	PINError *pivcard.PINError `json:"pinError,omitempty"`
+	PUKError *pivcard.PUKError `json:"pukError,omitempty"`
+
+	Public    *wireKey    `json:"public,omitempty"`
+	Shared    []byte      `json:"shared,omitempty"`
+	Signature []byte      `json:"signature,omitempty"`
+	Cards     []*cardInfo `json:"cards,omitempty"`
+	// Retries is a pointer so zero is sent too.
+	Retries *int `json:"retries,omitempty"`
+	// Attestation is in the format of pivcard.ParseAttestation.
+	Attestation []byte `json:"attestation,omitempty"`
+}
+
+type cardInfo struct {
+	Reader string     `json:"reader"`
+	Serial uint32     `json:"serial"`
+	Keys   []*keyInfo `json:"keys,omitempty"`
+}
+
+type keyInfo struct {
+	Slot   uint8    `json:"slot"`
+	Name   string   `json:"name"`
+	Public *wireKey `json:"public"`
+}
+
+// wireKey is a public key in a message. x509 knows nothing of X25519
+// keys, so they are sent raw.
+type wireKey struct {
+	// PKIX is set for ECDSA keys.
+	PKIX   []byte `json:"pkix,omitempty"`
+	X25519 []byte `json:"x25519,omitempty"`
+}
+
+func marshalPublic(pub crypto.PublicKey) (*wireKey, error) {
+	if x, ok := pub.(pivcard.X25519PublicKey); ok {
+		return &wireKey{X25519: x}, nil
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal public key: %v", err)
+	}
+	return &wireKey{PKIX: der}, nil
+}
+
+func parsePublic(k *wireKey) (crypto.PublicKey, error) {
+	if k == nil {
+		return nil, errors.New("missing public key")
+	}
+	if k.X25519 != nil {
+		if len(k.X25519) != pivcard.X25519KeySize {
+			return nil, errors.New("wrong X25519 public key size")
+		}
+		return pivcard.X25519PublicKey(k.X25519), nil
+	}
+	pub, err := x509.ParsePKIXPublicKey(k.PKIX)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key: %v", err)
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an ECDSA public key")
+	}
+	return ecPub, nil
+}
+
+// DefaultSocket returns where the agent listens when nothing else is
+// said, in the per-user runtime directory.
+func DefaultSocket() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		return "", errors.New("XDG_RUNTIME_DIR is not set, cannot choose agent socket")
+	}
+	return filepath.Join(dir, "age-plugin-yubikey", "agent.sock"), nil
+}
@@ -0,0 +1,171 @@
+package agent_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"eagain.net/go/yubage/internal/agent"
+	"eagain.net/go/yubage/internal/pivcard"
+)
+
+// startAgent runs an agent with an emulated card holding a key in
+// slot 82, with the PIN policy pinPolicy.
+func startAgent(t *testing.T, pinPolicy pivcard.PINPolicy, opts *agent.Options) (pivcard.Opener, string) {
+	t.Helper()
+	dir := t.TempDir()
+	emulator := pivcard.NewEmulator(filepath.Join(dir, "emulator.json"), nil)
+	keyOpts := &pivcard.KeyOptions{
+		PINPolicy:   pinPolicy,
+		TouchPolicy: pivcard.TouchPolicyNever,
+	}
+	if _, err := emulator.Generate(pivcard.EmulatorSerial, 0x82, keyOpts, func(string) (string, error) { return "123456", nil }); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	socket := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- agent.NewServer(emulator, opts).Serve(ctx, l)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	})
+	return agent.NewOpener(socket), socket
+}
+
+// sharedKey opens the card through the agent and does one key
+// agreement, counting the PIN prompts.
+func sharedKey(t *testing.T, cards pivcard.Opener, pin string, prompts *int) error {
+	t.Helper()
+	card, err := cards.Open(pivcard.EmulatorSerial, 0x82)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer card.Close()
+	eph, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt := func(string) (string, error) {
+		*prompts++
+		return pin, nil
+	}
+	notify := func(string) error { return nil }
+	_, err = card.SharedKey(context.Background(), &eph.PublicKey, prompt, notify)
+	return err
+}
+
+func TestAgentPINCache(t *testing.T) {
+	cards, socket := startAgent(t, pivcard.PINPolicyOnce, nil)
+
+	prompts := 0
+	for i := 0; i < 3; i++ {
+		if err := sharedKey(t, cards, "123456", &prompts); err != nil {
+			t.Fatalf("SharedKey: %v", err)
+		}
+	}
+	if prompts != 1 {
+		t.Errorf("PIN was asked %d times", prompts)
+	}
+
+	if err := agent.Lock(context.Background(), socket); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := sharedKey(t, cards, "123456", &prompts); err != nil {
+		t.Fatalf("SharedKey: %v", err)
+	}
+	if prompts != 2 {
+		t.Errorf("PIN was not asked after locking")
+	}
+}
+
+func TestAgentPINPolicyAlways(t *testing.T) {
+	cards, _ := startAgent(t, pivcard.PINPolicyAlways, nil)
+
+	prompts := 0
+	for i := 0; i < 3; i++ {
+		if err := sharedKey(t, cards, "123456", &prompts); err != nil {
+			t.Fatalf("SharedKey: %v", err)
+		}
+	}
+	if prompts != 3 {
+		t.Errorf("PIN was asked %d times", prompts)
+	}
+}
+
+func TestAgentNoPINCache(t *testing.T) {
+	cards, _ := startAgent(t, pivcard.PINPolicyOnce, &agent.Options{NoPINCache: true})
+
+	prompts := 0
+	for i := 0; i < 2; i++ {
+		if err := sharedKey(t, cards, "123456", &prompts); err != nil {
+			t.Fatalf("SharedKey: %v", err)
+		}
+	}
+	if prompts != 2 {
+		t.Errorf("PIN was asked %d times", prompts)
+	}
+}
+
+func TestAgentWrongPIN(t *testing.T) {
+	cards, _ := startAgent(t, pivcard.PINPolicyOnce, nil)
+
+	prompts := 0
+	err := sharedKey(t, cards, "000000", &prompts)
+	var pinErr *pivcard.PINError
+	if !errors.As(err, &pinErr) {
+		t.Fatalf("expected a PIN error: %v", err)
+	}
+	if pinErr.Retries != 2 {
+		t.Errorf("wrong retries: %d", pinErr.Retries)
+	}
+	// a wrong PIN is not remembered
+	if err := sharedKey(t, cards, "123456", &prompts); err != nil {
+		t.Fatalf("SharedKey: %v", err)
+	}
+	if prompts != 2 {
+		t.Errorf("PIN was asked %d times", prompts)
+	}
+}
+
+func TestAgentIdle(t *testing.T) {
+	cards, _ := startAgent(t, pivcard.PINPolicyOnce, &agent.Options{Idle: 10 * time.Millisecond})
+
+	prompts := 0
+	if err := sharedKey(t, cards, "123456", &prompts); err != nil {
+		t.Fatalf("SharedKey: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := sharedKey(t, cards, "123456", &prompts); err != nil {
+		t.Fatalf("SharedKey: %v", err)
+	}
+	if prompts != 2 {
+		t.Errorf("PIN was remembered after idle timeout")
+	}
+}
+
+func TestAgentList(t *testing.T) {
+	cards, _ := startAgent(t, pivcard.PINPolicyOnce, nil)
+	infos, err := cards.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(infos) != 1 || len(infos[0].Keys) != 1 || infos[0].Keys[0].Slot != 0x82 {
+		t.Fatalf("wrong cards: %v", infos)
+	}
+}
@@ -0,0 +1,253 @@
+package agent
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"eagain.net/go/yubage/internal/pivcard"
+)
+
+// client is a pivcard.Opener using the cards in an agent.
+type client struct {
+	socket string
+}
+
+// NewOpener returns an Opener that forwards everything to the agent
+// listening on socket.
+func NewOpener(socket string) pivcard.Opener {
+	return &client{socket: socket}
+}
+
+var _ pivcard.Opener = (*client)(nil)
+
+// call does one operation with the agent. Prompts are answered with
+// prompt, and notifications passed to notify; either may be nil if
+// the operation never needs them.
+func (c *client) call(ctx context.Context, req *request, prompt pivcard.Prompter, notify pivcard.Notifier) (*message, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", c.socket)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to agent: %v", err)
+	}
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblock reads and writes, the agent notices the
+			// connection going away
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	enc := json.NewEncoder(conn)
+	dec := json.NewDecoder(conn)
+	if err := enc.Encode(req); err != nil {
+		return nil, c.connError(ctx, err)
+	}
+	for {
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			return nil, c.connError(ctx, err)
+		}
+		switch msg.Kind {
+		case kindPrompt:
+			if prompt == nil {
+				return nil, errors.New("agent asked an unexpected question")
+			}
+			var a answer
+			s, err := prompt(msg.Text)
+			if err != nil {
+				a.Error = err.Error()
+			}
+			a.Answer = s
+			if err := enc.Encode(&a); err != nil {
+				return nil, c.connError(ctx, err)
+			}
+			if err != nil {
+				return nil, err
+			}
+		case kindNotify:
+			if notify == nil {
+				continue
+			}
+			if err := notify(msg.Text); err != nil {
+				return nil, err
+			}
+		case kindResult:
+			if msg.PINError != nil {
+				return nil, msg.PINError
+			}
+			if msg.PUKError != nil {
+				return nil, msg.PUKError
+			}
+			if msg.Error != "" {
+				return nil, errors.New(msg.Error)
+			}
+			return &msg, nil
+		default:
+			return nil, fmt.Errorf("unknown message from agent: %q", msg.Kind)
+		}
+	}
+}
+
+func (c *client) connError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("agent request abandoned: %w", ctx.Err())
+	}
+	return fmt.Errorf("agent connection failed: %v", err)
+}
+
+func (c *client) Open(serial uint32, slot uint8) (pivcard.Card, error) {
+	msg, err := c.call(context.Background(), &request{Op: opOpen, Serial: serial, Slot: slot}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := parsePublic(msg.Public)
+	if err != nil {
+		return nil, err
+	}
+	card := &agentHandle{
+		client: c,
+		serial: serial,
+		slot:   slot,
+		pub:    pub,
+	}
+	return card, nil
+}
+
+func (c *client) Generate(serial uint32, slot uint8, opts *pivcard.KeyOptions, prompt pivcard.Prompter) (crypto.PublicKey, error) {
+	req := &request{
+		Op:         opGenerate,
+		Serial:     serial,
+		Slot:       slot,
+		KeyOptions: opts,
+	}
+	msg, err := c.call(context.Background(), req, prompt, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parsePublic(msg.Public)
+}
+
+func (c *client) List() ([]*pivcard.CardInfo, error) {
+	msg, err := c.call(context.Background(), &request{Op: opList}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var infos []*pivcard.CardInfo
+	for _, ci := range msg.Cards {
+		info := &pivcard.CardInfo{Reader: ci.Reader, Serial: ci.Serial}
+		for _, k := range ci.Keys {
+			pub, err := parsePublic(k.Public)
+			if err != nil {
+				return nil, err
+			}
+			info.Keys = append(info.Keys, &pivcard.KeyInfo{Slot: k.Slot, Name: k.Name, Public: pub})
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (c *client) Attest(serial uint32, slot uint8) (*pivcard.Attestation, error) {
+	req := &request{
+		Op:     opAttest,
+		Serial: serial,
+		Slot:   slot,
+	}
+	msg, err := c.call(context.Background(), req, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return pivcard.ParseAttestation(msg.Attestation)
+}
+
+func (c *client) Unblock(serial uint32, puk string, newPIN string) error {
+	req := &request{
+		Op:     opUnblock,
+		Serial: serial,
+		PUK:    puk,
+		NewPIN: newPIN,
+	}
+	_, err := c.call(context.Background(), req, nil, nil)
+	return err
+}
+
+// Lock makes the agent on socket close all cards, so they forget the
+// PIN.
+func Lock(ctx context.Context, socket string) error {
+	c := &client{socket: socket}
+	_, err := c.call(ctx, &request{Op: opLock}, nil, nil)
+	return err
+}
+
+// agentHandle is a card held open by the agent. Closing it leaves
+// the card open in the agent.
+type agentHandle struct {
+	client *client
+	serial uint32
+	slot   uint8
+	pub    crypto.PublicKey
+}
+
+var _ pivcard.Card = (*agentHandle)(nil)
+
+func (h *agentHandle) Close() error {
+	return nil
+}
+
+func (h *agentHandle) Public() crypto.PublicKey {
+	return h.pub
+}
+
+func (h *agentHandle) Retries() (int, error) {
+	msg, err := h.client.call(context.Background(), &request{Op: opRetries, Serial: h.serial, Slot: h.slot}, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	if msg.Retries == nil {
+		return 0, errors.New("agent did not say PIN retries")
+	}
+	return *msg.Retries, nil
+}
+
+func (h *agentHandle) SharedKey(ctx context.Context, peer crypto.PublicKey, prompt pivcard.Prompter, notify pivcard.Notifier) ([]byte, error) {
+	wire, err := marshalPublic(peer)
+	if err != nil {
+		return nil, err
+	}
+	req := &request{
+		Op:     opSharedKey,
+		Serial: h.serial,
+		Slot:   h.slot,
+		Peer:   wire,
+	}
+	msg, err := h.client.call(ctx, req, prompt, notify)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Shared, nil
+}
+
+func (h *agentHandle) Sign(ctx context.Context, digest []byte, prompt pivcard.Prompter, notify pivcard.Notifier) ([]byte, error) {
+	req := &request{
+		Op:     opSign,
+		Serial: h.serial,
+		Slot:   h.slot,
+		Digest: digest,
+	}
+	msg, err := h.client.call(ctx, req, prompt, notify)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Signature, nil
+}
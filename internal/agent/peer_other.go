@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package agent
+
+import "net"
+
+// checkPeer refuses clients running as another user. Only Linux is
+// supported for now; elsewhere, the socket permissions keep others
+// out.
+func checkPeer(conn net.Conn) error {
+	return nil
+}
@@ -0,0 +1,361 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"eagain.net/go/yubage/internal/pivcard"
+)
+
+// Options adjust the agent.
+type Options struct {
+	// Idle is how long the agent keeps cards open after the last
+	// use. Zero means forever.
+	Idle time.Duration
+	// NoPINCache makes the agent close cards right after use, so
+	// they forget the PIN even with the PIN policy "once".
+	NoPINCache bool
+}
+
+type cardKey struct {
+	serial uint32
+	slot   uint8
+}
+
+type agentCard struct {
+	card pivcard.Card
+}
+
+// Server holds cards open for clients.
+type Server struct {
+	opener pivcard.Opener
+	opts   Options
+
+	// mu serializes all card access, and protects the fields
+	// below.
+	mu        sync.Mutex
+	cards     map[cardKey]*agentCard
+	idleTimer *time.Timer
+}
+
+// NewServer returns an agent using the cards in opener. opts may be
+// nil.
+func NewServer(opener pivcard.Opener, opts *Options) *Server {
+	s := &Server{
+		opener: opener,
+		cards:  make(map[cardKey]*agentCard),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	return s
+}
+
+// Serve accepts clients on l until ctx is done or l fails. It locks
+// the agent before returning.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	defer s.Lock()
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// Lock closes all cards, so they forget the PIN.
+func (s *Server) Lock() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lockLocked()
+}
+
+func (s *Server) lockLocked() {
+	debugf("locking")
+	s.closeCardsLocked()
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+}
+
+func (s *Server) closeCardsLocked() {
+	for key, c := range s.cards {
+		if err := c.card.Close(); err != nil {
+			debugf("error closing card: %v", err)
+		}
+		delete(s.cards, key)
+	}
+}
+
+// touchLocked restarts the idle timer.
+func (s *Server) touchLocked() {
+	if s.opts.Idle == 0 {
+		return
+	}
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+	s.idleTimer = time.AfterFunc(s.opts.Idle, func() {
+		debugf("idle timeout")
+		s.Lock()
+	})
+}
+
+// clientConn is the agent end of a client connection.
+type clientConn struct {
+	enc *json.Encoder
+	// answers are read in the background, so a client going away
+	// is noticed also while the card is busy
+	answers <-chan *answer
+}
+
+func (c *clientConn) prompt(ctx context.Context, text string) (string, error) {
+	if err := c.enc.Encode(&message{Kind: kindPrompt, Text: text}); err != nil {
+		return "", err
+	}
+	select {
+	case a, ok := <-c.answers:
+		if !ok {
+			return "", errors.New("client went away")
+		}
+		if a.Error != "" {
+			return "", errors.New(a.Error)
+		}
+		return a.Answer, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (c *clientConn) notify(text string) error {
+	return c.enc.Encode(&message{Kind: kindNotify, Text: text})
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	if err := checkPeer(conn); err != nil {
+		debugf("%v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dec := json.NewDecoder(conn)
+	var req request
+	if err := dec.Decode(&req); err != nil {
+		debugf("bad request: %v", err)
+		return
+	}
+	answers := make(chan *answer)
+	go func() {
+		defer close(answers)
+		defer cancel()
+		for {
+			var a answer
+			if err := dec.Decode(&a); err != nil {
+				return
+			}
+			select {
+			case answers <- &a:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	client := &clientConn{
+		enc:     json.NewEncoder(conn),
+		answers: answers,
+	}
+
+	result, err := s.handle(ctx, &req, client)
+	if err != nil {
+		debugf("%s failed: %v", req.Op, err)
+		result = &message{Error: err.Error()}
+		var pinErr *pivcard.PINError
+		if errors.As(err, &pinErr) {
+			result.PINError = pinErr
+		}
+		var pukErr *pivcard.PUKError
+		if errors.As(err, &pukErr) {
+			result.PUKError = pukErr
+		}
+	}
+	result.Kind = kindResult
+	if err := client.enc.Encode(result); err != nil {
+		debugf("cannot send result: %v", err)
+	}
+}
+
+func (s *Server) handle(ctx context.Context, req *request, client *clientConn) (*message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.touchLocked()
+
+	switch req.Op {
+	case opOpen:
+		c, err := s.openLocked(req.Serial, req.Slot)
+		if err != nil {
+			return nil, err
+		}
+		pub, err := marshalPublic(c.card.Public())
+		if err != nil {
+			return nil, err
+		}
+		return &message{Public: pub}, nil
+
+	case opSharedKey:
+		peer, err := parsePublic(req.Peer)
+		if err != nil {
+			return nil, err
+		}
+		c, err := s.openLocked(req.Serial, req.Slot)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := s.useCardLocked(ctx, cardKey{req.Serial, req.Slot}, c, client, func(prompt pivcard.Prompter) ([]byte, error) {
+			return c.card.SharedKey(ctx, peer, prompt, client.notify)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &message{Shared: shared}, nil
+
+	case opSign:
+		c, err := s.openLocked(req.Serial, req.Slot)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := s.useCardLocked(ctx, cardKey{req.Serial, req.Slot}, c, client, func(prompt pivcard.Prompter) ([]byte, error) {
+			return c.card.Sign(ctx, req.Digest, prompt, client.notify)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &message{Signature: sig}, nil
+
+	case opRetries:
+		c, err := s.openLocked(req.Serial, req.Slot)
+		if err != nil {
+			return nil, err
+		}
+		retries, err := c.card.Retries()
+		if err != nil {
+			return nil, err
+		}
+		return &message{Retries: &retries}, nil
+
+	case opUnblock:
+		// free the card
+		s.closeCardsLocked()
+		if err := s.opener.Unblock(req.Serial, req.PUK, req.NewPIN); err != nil {
+			return nil, err
+		}
+		return &message{}, nil
+
+	case opAttest:
+		s.closeCardsLocked()
+		a, err := s.opener.Attest(req.Serial, req.Slot)
+		if err != nil {
+			return nil, err
+		}
+		return &message{Attestation: a.MarshalPEM()}, nil
+
+	case opList:
+		// The cards need to be free for listing.
+		s.closeCardsLocked()
+		infos, err := s.opener.List()
+		if err != nil {
+			return nil, err
+		}
+		result := &message{}
+		for _, info := range infos {
+			ci := &cardInfo{Reader: info.Reader, Serial: info.Serial}
+			for _, k := range info.Keys {
+				pub, err := marshalPublic(k.Public)
+				if err != nil {
+					return nil, err
+				}
+				ci.Keys = append(ci.Keys, &keyInfo{Slot: k.Slot, Name: k.Name, Public: pub})
+			}
+			result.Cards = append(result.Cards, ci)
+		}
+		return result, nil
+
+	case opGenerate:
+		if req.KeyOptions == nil {
+			return nil, errors.New("generate without key options")
+		}
+		s.closeCardsLocked()
+		prompt := func(text string) (string, error) {
+			return client.prompt(ctx, text)
+		}
+		pub, err := s.opener.Generate(req.Serial, req.Slot, req.KeyOptions, prompt)
+		if err != nil {
+			return nil, err
+		}
+		wire, err := marshalPublic(pub)
+		if err != nil {
+			return nil, err
+		}
+		return &message{Public: wire}, nil
+
+	case opLock:
+		s.lockLocked()
+		return &message{}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown agent operation: %q", req.Op)
+	}
+}
+
+func (s *Server) openLocked(serial uint32, slot uint8) (*agentCard, error) {
+	key := cardKey{serial: serial, slot: slot}
+	if c, ok := s.cards[key]; ok {
+		return c, nil
+	}
+	debugf("opening Yubikey %d slot %02x", serial, slot)
+	card, err := s.opener.Open(serial, slot)
+	if err != nil {
+		return nil, err
+	}
+	c := &agentCard{card: card}
+	s.cards[key] = c
+	return c, nil
+}
+
+// useCardLocked runs fn with a prompt asking the client. The agent
+// never remembers PINs itself: keeping the card open is what lets the
+// PIN policy "once" cover later uses, and the policy "always" asks
+// every time.
+func (s *Server) useCardLocked(ctx context.Context, key cardKey, c *agentCard, client *clientConn, fn func(prompt pivcard.Prompter) ([]byte, error)) ([]byte, error) {
+	prompt := func(text string) (string, error) {
+		return client.prompt(ctx, text)
+	}
+	out, err := fn(prompt)
+	// after giving up, the card may still be busy; start over next
+	// time
+	if ctx.Err() != nil || s.opts.NoPINCache {
+		if err := c.card.Close(); err != nil {
+			debugf("error closing card: %v", err)
+		}
+		delete(s.cards, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
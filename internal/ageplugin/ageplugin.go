@@ -1,29 +1,24 @@
-// Package ageplugin talks the plugin side of the age plugin protocol.
+// Package ageplugin talks the age plugin protocol, both as the plugin
+// and as the host running plugins.
 package ageplugin
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"strings"
-)
-
-const (
-	debug = false
+	"sync"
+	"time"
 
-	// setting this leaks ephemeral file keys and PINs into stderr/syslog
-	debugStanzas = false
+	"eagain.net/go/yubage/internal/debuglog"
 )
 
 func debugf(format string, args ...interface{}) {
-	if debug {
-		log.Printf(format, args...)
-	}
+	debuglog.Printf("ageplugin", format, args...)
 }
 
 const (
@@ -31,15 +26,33 @@ const (
 )
 
 type Conn struct {
-	r *bufio.Reader
-	w io.Writer
+	// rawReader is kept for interrupting blocked reads
+	rawReader io.Reader
+	r         *bufio.Reader
+	w         io.Writer
+	// body is the body of the last stanza read, if not read until
+	// the end yet
+	body *bodyReader
+	// broken is set when I/O was abandoned halfway, and the
+	// stream is in an unknown state
+	mu     sync.Mutex
+	broken error
+	// transcript records the stanzas, if set
+	transcript *Transcript
+}
+
+func (conn *Conn) brokenErr() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.broken
 }
 
 func New(r io.Reader, w io.Writer) *Conn {
 	br := bufio.NewReader(r)
 	c := &Conn{
-		r: br,
-		w: w,
+		rawReader: r,
+		r:         br,
+		w:         w,
 	}
 	return c
 }
@@ -50,6 +63,47 @@ type Stanza struct {
 	Body []byte
 }
 
+// SyntaxError reports a stanza that breaks the rules of the protocol,
+// either read from the peer or about to be written.
+type SyntaxError struct {
+	// Type and Args are the stanza as far as it could be parsed.
+	Type string
+	Args []string
+	// Reason says what is wrong.
+	Reason string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid stanza %q: %s", strings.Join(append([]string{e.Type}, e.Args...), " "), e.Reason)
+}
+
+// isValidString is the rule for stanza types and arguments, as in
+// isValidString in ageinternal/format: non-empty, printable ASCII
+// without spaces.
+func isValidString(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, c := range s {
+		if c < 33 || c > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+func validateStanza(typ string, args []string) error {
+	if !isValidString(typ) {
+		return &SyntaxError{Type: typ, Args: args, Reason: "malformed type"}
+	}
+	for i, arg := range args {
+		if !isValidString(arg) {
+			return &SyntaxError{Type: typ, Args: args, Reason: fmt.Sprintf("malformed argument %d", i)}
+		}
+	}
+	return nil
+}
+
 func noEOF(err error) error {
 	// age protocols include a well-defined shutdown and
 	// are not terminated implicitly by EOF
@@ -59,104 +113,312 @@ func noEOF(err error) error {
 	return err
 }
 
+// deadliner is implemented by readers and writers that can
+// interrupt blocked I/O, such as *os.File for pipes.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// do runs the blocking I/O in fn, giving up when ctx is done. Giving
+// up leaves a read or write halfway, so the connection can no longer
+// be used.
+func (conn *Conn) do(ctx context.Context, fn func() error) error {
+	if err := conn.brokenErr(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return fn()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// fn may have finished at the same time, don't throw away
+		// its result
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+		conn.mu.Lock()
+		conn.broken = fmt.Errorf("connection abandoned: %w", ctx.Err())
+		conn.mu.Unlock()
+		// Unblock the goroutine, if we can. Otherwise it stays
+		// around until the other side does something, which is
+		// fine for a process that is about to exit.
+		for _, f := range []interface{}{conn.rawReader, conn.w} {
+			if d, ok := f.(deadliner); ok {
+				_ = d.SetDeadline(time.Unix(1, 0))
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+// ReadStanza reads a whole stanza, including the body.
 func (conn *Conn) ReadStanza() (*Stanza, error) {
+	return conn.ReadStanzaContext(context.Background())
+}
+
+// ReadStanzaContext is ReadStanza, giving up when ctx is done. After
+// that, the connection cannot be used anymore.
+func (conn *Conn) ReadStanzaContext(ctx context.Context) (*Stanza, error) {
+	var s *Stanza
+	err := conn.do(ctx, func() error {
+		var err error
+		s, err = conn.readStanza()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (conn *Conn) readStanza() (*Stanza, error) {
+	s, body, err := conn.ReadStanzaStream()
+	if err != nil {
+		return nil, err
+	}
+	s.Body, err = ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ReadStanzaStream reads the type and arguments of the next stanza,
+// and returns a reader for the decoded body. Body is not set in the
+// returned stanza. Whatever is left unread of the body is skipped
+// by the next read.
+func (conn *Conn) ReadStanzaStream() (*Stanza, io.Reader, error) {
+	if err := conn.brokenErr(); err != nil {
+		return nil, nil, err
+	}
+	if conn.body != nil {
+		if _, err := io.Copy(ioutil.Discard, conn.body); err != nil {
+			return nil, nil, err
+		}
+		conn.body = nil
+	}
+
 	line, err := conn.r.ReadString('\n')
 	if err != nil {
-		return nil, fmt.Errorf("read stanza: %w", noEOF(err))
+		return nil, nil, fmt.Errorf("read stanza: %w", noEOF(err))
 	}
+	line = strings.TrimSuffix(line, "\n")
 	if !strings.HasPrefix(line, cmdPrefix) {
-		return nil, errors.New("no command recognized in input")
+		return nil, nil, &SyntaxError{Type: line, Reason: "no command recognized in input"}
 	}
 	line = line[len(cmdPrefix):]
-	line = strings.TrimSuffix(line, "\n")
 	args := strings.Split(line, " ")
 	cmd, args := args[0], args[1:]
+	if err := validateStanza(cmd, args); err != nil {
+		return nil, nil, err
+	}
 
-	// Consume body. Construct an io.Reader to hand off to
-	// base64.NewDecoder. We could be more clever, stream it while
-	// feigning EOF at the right time -- but why bother, gather it
-	// into an in-memory buffer line by line.
-	//
-	// Assumption: Bodies are small enough to read into memory.
-	buf := new(bytes.Buffer)
-	for {
-		line, err := conn.r.ReadBytes('\n')
+	s := &Stanza{
+		Type: cmd,
+		Args: args,
+	}
+	conn.body = &bodyReader{
+		r:   conn.r,
+		typ: cmd,
+		rec: conn.transcript.start(TranscriptIn, cmd, args),
+	}
+	return s, conn.body, nil
+}
+
+// bodyLineLength is the number of base64 characters on each full line
+// of a stanza body.
+const bodyLineLength = 64
+
+// bodyReader decodes a stanza body one line at a time.
+type bodyReader struct {
+	r   *bufio.Reader
+	typ string
+	rec *recording
+	// buf holds decoded data not yet returned
+	buf  []byte
+	done bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+		line, err := b.r.ReadBytes('\n')
 		if err != nil {
-			return nil, fmt.Errorf("reading line: %w", noEOF(err))
+			return 0, fmt.Errorf("reading line: %w", noEOF(err))
 		}
-		if len(line) > 64+1 {
-			return nil, errors.New("line is too long")
+		line = line[:len(line)-1]
+		if len(line) > bodyLineLength {
+			return 0, &SyntaxError{Type: b.typ, Reason: "body line is too long"}
 		}
-		_, _ = buf.Write(line)
-		if len(line) < 64+1 {
-			// Stanzas are terminated also by end of base64-encoded
+		if len(line) < bodyLineLength {
+			// Stanzas are terminated by end of base64-encoded
 			// data, detected as a partial line (or empty line). An
 			// example complete stanza is `-> foo\nYmFy\n`, no final
-			// empty line.
-			//
-			// This logic also detects empty lines.
-			//
-			// This is needed for when the parent switches to reading
-			// from us, but is not consistently used to terminate all
-			// bodies.
-			break
+			// empty line. A body that is a multiple of full lines
+			// is followed by an empty line.
+			b.done = true
+		}
+		// Full lines are a multiple of 4 characters, so every line
+		// decodes on its own.
+		decoded := make([]byte, base64.RawStdEncoding.DecodedLen(len(line)))
+		n, err := base64.RawStdEncoding.Strict().Decode(decoded, line)
+		if err != nil {
+			return 0, &SyntaxError{Type: b.typ, Reason: fmt.Sprintf("malformed body: %v", err)}
+		}
+		b.buf = decoded[:n]
+		b.rec.add(b.buf)
+		if b.done {
+			b.rec.finish()
 		}
 	}
-	dec := base64.NewDecoder(base64.RawStdEncoding.Strict(), buf)
-	body, err := ioutil.ReadAll(dec)
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// WriteStanza writes a whole stanza.
+func (conn *Conn) WriteStanza(s *Stanza) error {
+	return conn.WriteStanzaContext(context.Background(), s)
+}
+
+// WriteStanzaContext is WriteStanza, giving up when ctx is done.
+// After that, the connection cannot be used anymore.
+func (conn *Conn) WriteStanzaContext(ctx context.Context, s *Stanza) error {
+	return conn.do(ctx, func() error {
+		return conn.writeStanza(s)
+	})
+}
+
+func (conn *Conn) writeStanza(s *Stanza) error {
+	w, err := conn.WriteStanzaStream(s.Type, s.Args)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	s := &Stanza{
-		Type: cmd,
-		Args: args,
-		Body: body,
+	if _, err := w.Write(s.Body); err != nil {
+		return err
 	}
-	if debugStanzas {
-		debugf("read: %q %q %q", s.Type, s.Args, s.Body)
+	if err := w.Close(); err != nil {
+		return err
 	}
-	return s, nil
+	return nil
 }
 
-func (conn *Conn) WriteStanza(s *Stanza) error {
-	// TODO validate outgoing Cmd & Args for character set, utf-8
-	if debugStanzas {
-		debugf("write: %q %q %q", s.Type, s.Args, s.Body)
+// WriteStanzaStream writes the type and arguments of a stanza, and
+// returns a writer for the body. The stanza is complete only once the
+// writer is closed, and nothing else may be written before that.
+func (conn *Conn) WriteStanzaStream(typ string, args []string) (io.WriteCloser, error) {
+	if err := conn.brokenErr(); err != nil {
+		return nil, err
+	}
+	// refuse to send anything the other side could misparse
+	if err := validateStanza(typ, args); err != nil {
+		return nil, err
 	}
 	buf := new(bytes.Buffer)
 	buf.WriteString("-> ")
-	buf.WriteString(s.Type)
-	for _, arg := range s.Args {
+	buf.WriteString(typ)
+	for _, arg := range args {
 		buf.WriteString(" ")
 		buf.WriteString(arg)
 	}
 	buf.WriteString("\n")
 	if _, err := conn.w.Write(buf.Bytes()); err != nil {
-		return err
+		return nil, err
 	}
-	// TODO wrap lines at the correct column; won't trigger with
-	// our small data sizes
-	bodyWriter := base64.NewEncoder(base64.RawStdEncoding, conn.w)
-	if _, err := bodyWriter.Write(s.Body); err != nil {
-		return err
+	lines := &lineWrapper{w: conn.w}
+	w := &bodyWriter{
+		enc:   base64.NewEncoder(base64.RawStdEncoding, lines),
+		lines: lines,
+		rec:   conn.transcript.start(TranscriptOut, typ, args),
+	}
+	return w, nil
+}
+
+// lineWrapper breaks base64 output into lines of bodyLineLength.
+type lineWrapper struct {
+	w      io.Writer
+	column int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if l.column == bodyLineLength {
+			if _, err := io.WriteString(l.w, "\n"); err != nil {
+				return written, err
+			}
+			l.column = 0
+		}
+		chunk := p
+		if room := bodyLineLength - l.column; len(chunk) > room {
+			chunk = chunk[:room]
+		}
+		n, err := l.w.Write(chunk)
+		written += n
+		l.column += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
 	}
-	if err := bodyWriter.Close(); err != nil {
+	return written, nil
+}
+
+type bodyWriter struct {
+	enc   io.WriteCloser
+	lines *lineWrapper
+	rec   *recording
+}
+
+func (b *bodyWriter) Write(p []byte) (int, error) {
+	n, err := b.enc.Write(p)
+	b.rec.add(p[:n])
+	return n, err
+}
+
+func (b *bodyWriter) Close() error {
+	if err := b.enc.Close(); err != nil {
 		return err
 	}
-	if _, err := io.WriteString(conn.w, "\n"); err != nil {
+	end := "\n"
+	if b.lines.column == bodyLineLength {
+		// a full last line would not end the body
+		end = "\n\n"
+	}
+	if _, err := io.WriteString(b.lines.w, end); err != nil {
 		return err
 	}
+	b.rec.finish()
 	return nil
 }
 
+// Prompt asks the user for a secret, such as a PIN.
 func (conn *Conn) Prompt(question string) (string, error) {
-	if err := conn.WriteStanza(&Stanza{
+	return conn.PromptContext(context.Background(), question)
+}
+
+// PromptContext is Prompt, giving up when ctx is done.
+func (conn *Conn) PromptContext(ctx context.Context, question string) (string, error) {
+	if err := conn.WriteStanzaContext(ctx, &Stanza{
 		Type: "request-secret",
 		Body: []byte(question),
 	}); err != nil {
 		return "", fmt.Errorf("writing request-secret failed: %v", err)
 	}
-	ok, err := conn.ReadStanza()
+	ok, err := conn.ReadStanzaContext(ctx)
 	if err != nil {
 		return "", fmt.Errorf("reading request-secret response failed: %v", err)
 	}
@@ -170,8 +432,73 @@ func (conn *Conn) Prompt(question string) (string, error) {
 	return response, nil
 }
 
+// Message shows text to the user, without expecting an answer.
+func (conn *Conn) Message(text string) error {
+	return conn.MessageContext(context.Background(), text)
+}
+
+// MessageContext is Message, giving up when ctx is done.
+func (conn *Conn) MessageContext(ctx context.Context, text string) error {
+	if err := conn.WriteStanzaContext(ctx, &Stanza{
+		Type: "msg",
+		Body: []byte(text),
+	}); err != nil {
+		return fmt.Errorf("writing msg failed: %v", err)
+	}
+	if err := conn.ReadOkContext(ctx); err != nil {
+		return fmt.Errorf("msg: %v", err)
+	}
+	return nil
+}
+
+// Confirm asks the user a question with two possible answers, yes
+// and no. No may be empty, for a question with only one answer to
+// acknowledge it. The result reports whether the user chose yes.
+func (conn *Conn) Confirm(text string, yes string, no string) (bool, error) {
+	return conn.ConfirmContext(context.Background(), text, yes, no)
+}
+
+// ConfirmContext is Confirm, giving up when ctx is done.
+func (conn *Conn) ConfirmContext(ctx context.Context, text string, yes string, no string) (bool, error) {
+	args := []string{base64.RawStdEncoding.EncodeToString([]byte(yes))}
+	if no != "" {
+		args = append(args, base64.RawStdEncoding.EncodeToString([]byte(no)))
+	}
+	if err := conn.WriteStanzaContext(ctx, &Stanza{
+		Type: "confirm",
+		Args: args,
+		Body: []byte(text),
+	}); err != nil {
+		return false, fmt.Errorf("writing confirm failed: %v", err)
+	}
+	ok, err := conn.ReadStanzaContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("reading confirm response failed: %v", err)
+	}
+	if ok.Type != "ok" {
+		return false, fmt.Errorf("bad confirm response: %q", ok.Type)
+	}
+	if len(ok.Args) != 1 {
+		return false, fmt.Errorf("bad confirm response args: %#v", ok.Args)
+	}
+	switch ok.Args[0] {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	default:
+		return false, fmt.Errorf("bad confirm answer: %q", ok.Args[0])
+	}
+}
+
+// ReadOk reads an ok response with no arguments or body.
 func (conn *Conn) ReadOk() error {
-	ok, err := conn.ReadStanza()
+	return conn.ReadOkContext(context.Background())
+}
+
+// ReadOkContext is ReadOk, giving up when ctx is done.
+func (conn *Conn) ReadOkContext(ctx context.Context) error {
+	ok, err := conn.ReadStanzaContext(ctx)
 	if err != nil {
 		return fmt.Errorf("cannot read result stanza: %v", err)
 	}
@@ -2,9 +2,15 @@ package ageplugin_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"eagain.net/go/yubage/internal/ageplugin"
 	"github.com/google/go-cmp/cmp"
@@ -76,3 +82,193 @@ func TestWriteStanza(t *testing.T) {
 		t.Errorf("wrong stanza (-got +want)\n%s", diff)
 	}
 }
+
+func TestWriteStanzaWrap(t *testing.T) {
+	for _, size := range []int{0, 1, 47, 48, 49, 96, 1000} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			body := bytes.Repeat([]byte{0xa5}, size)
+			buf := new(bytes.Buffer)
+			conn := ageplugin.New(buf, buf)
+			if err := conn.WriteStanza(&ageplugin.Stanza{Type: "big", Body: body}); err != nil {
+				t.Fatalf("WriteStanza: %v", err)
+			}
+			if err := conn.WriteStanza(&ageplugin.Stanza{Type: "next"}); err != nil {
+				t.Fatalf("WriteStanza: %v", err)
+			}
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			for _, line := range lines[1 : len(lines)-3] {
+				if len(line) != 64 {
+					t.Errorf("wrong line length %d: %q", len(line), line)
+				}
+			}
+			if last := lines[len(lines)-3]; len(last) >= 64 {
+				t.Errorf("body does not end in a partial line: %q", last)
+			}
+
+			got, err := conn.ReadStanza()
+			if err != nil {
+				t.Fatalf("ReadStanza: %v", err)
+			}
+			if !bytes.Equal(got.Body, body) {
+				t.Errorf("wrong body: %x", got.Body)
+			}
+			next, err := conn.ReadStanza()
+			if err != nil {
+				t.Fatalf("ReadStanza: %v", err)
+			}
+			if g, e := next.Type, "next"; g != e {
+				t.Errorf("wrong stanza after body: %q != %q", g, e)
+			}
+		})
+	}
+}
+
+func TestStanzaStream(t *testing.T) {
+	buf := new(bytes.Buffer)
+	conn := ageplugin.New(buf, buf)
+	w, err := conn.WriteStanzaStream("blob", []string{"x"})
+	if err != nil {
+		t.Fatalf("WriteStanzaStream: %v", err)
+	}
+	var want []byte
+	for i := 0; i < 100; i++ {
+		chunk := bytes.Repeat([]byte{byte(i)}, i)
+		want = append(want, chunk...)
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := conn.WriteStanza(&ageplugin.Stanza{Type: "blob"}); err != nil {
+		t.Fatalf("WriteStanza: %v", err)
+	}
+	if err := conn.WriteStanza(&ageplugin.Stanza{Type: "done"}); err != nil {
+		t.Fatalf("WriteStanza: %v", err)
+	}
+
+	s, body, err := conn.ReadStanzaStream()
+	if err != nil {
+		t.Fatalf("ReadStanzaStream: %v", err)
+	}
+	if diff := cmp.Diff(s, &ageplugin.Stanza{Type: "blob", Args: []string{"x"}}); diff != "" {
+		t.Errorf("wrong stanza (-got +want)\n%s", diff)
+	}
+	got, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("wrong body")
+	}
+
+	// unread bodies are skipped
+	if _, _, err := conn.ReadStanzaStream(); err != nil {
+		t.Fatalf("ReadStanzaStream: %v", err)
+	}
+	done, err := conn.ReadStanza()
+	if err != nil {
+		t.Fatalf("ReadStanza: %v", err)
+	}
+	if g, e := done.Type, "done"; g != e {
+		t.Errorf("wrong stanza: %q != %q", g, e)
+	}
+}
+
+func TestReadStanzaLongLine(t *testing.T) {
+	in := new(bytes.Buffer)
+	conn := ageplugin.New(in, ioutil.Discard)
+	in.WriteString("-> foo\n" + strings.Repeat("A", 65) + "\n")
+	if _, err := conn.ReadStanza(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestReadStanzaInvalid(t *testing.T) {
+	for _, input := range []string{
+		"foo\n\n",
+		"-> \n\n",
+		"-> foo  bar\n\n",
+		"-> foo bar \n\n",
+		"-> foo bär\n\n",
+		"-> foo bar\r\n\n",
+		"-> foo\tbar\n\n",
+		"-> foo\n!!!!\n",
+	} {
+		t.Run(input, func(t *testing.T) {
+			in := new(bytes.Buffer)
+			conn := ageplugin.New(in, ioutil.Discard)
+			in.WriteString(input)
+			got, err := conn.ReadStanza()
+			var syntaxErr *ageplugin.SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("expected a syntax error: %v", err)
+			}
+			if got != nil {
+				t.Errorf("bad stanza: %+v", got)
+			}
+		})
+	}
+}
+
+func TestWriteStanzaInvalid(t *testing.T) {
+	for _, s := range []*ageplugin.Stanza{
+		{Type: ""},
+		{Type: "foo bar"},
+		{Type: "foo\n"},
+		{Type: "foo", Args: []string{""}},
+		{Type: "foo", Args: []string{"bar", "b a z"}},
+		{Type: "foo", Args: []string{"ä"}},
+	} {
+		t.Run(s.Type, func(t *testing.T) {
+			out := new(bytes.Buffer)
+			conn := ageplugin.New(new(bytes.Buffer), out)
+			err := conn.WriteStanza(s)
+			var syntaxErr *ageplugin.SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("expected a syntax error: %v", err)
+			}
+			if out.Len() != 0 {
+				t.Errorf("unexpected output:\n%s", out.Bytes())
+			}
+		})
+	}
+}
+
+func TestReadStanzaContext(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	conn := ageplugin.New(r, ioutil.Discard)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := conn.ReadStanzaContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout: %v", err)
+	}
+
+	// the connection is not usable after giving up
+	if _, err := w.WriteString("-> foo\n\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ReadStanza(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("abandoned connection was used: %v", err)
+	}
+}
+
+func TestPromptContextCanceled(t *testing.T) {
+	out := new(bytes.Buffer)
+	conn := ageplugin.New(new(bytes.Buffer), out)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := conn.PromptContext(ctx, "PIN?"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if out.Len() != 0 {
+		t.Errorf("unexpected output:\n%s", out.Bytes())
+	}
+}
@@ -0,0 +1,451 @@
+package ageplugin
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// Host talks the parent side of the age plugin protocol, launching
+// plugin binaries as subprocesses.
+type Host struct {
+	// Path is the plugin binary to run.
+	Path string
+
+	// RequestSecret answers request-secret callbacks from the
+	// plugin, such as PIN prompts. If nil, the requests are refused.
+	RequestSecret func(question string) (string, error)
+
+	// DisplayMessage shows msg callbacks from the plugin, such as
+	// requests to touch a hardware token. If nil, the messages are
+	// dropped.
+	DisplayMessage func(text string) error
+
+	// Confirm answers confirm callbacks from the plugin, reporting
+	// whether the user chose yes. No is empty when there is only
+	// one choice. If nil, the requests are refused.
+	Confirm func(text string, yes string, no string) (bool, error)
+
+	// Stderr receives the standard error of the plugin. If nil,
+	// os.Stderr is used.
+	Stderr io.Writer
+}
+
+// NewHost returns a Host for the plugin called name, found as the
+// binary age-plugin-NAME in PATH.
+func NewHost(name string) (*Host, error) {
+	path, err := exec.LookPath("age-plugin-" + name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find plugin %q: %w", name, err)
+	}
+	h := &Host{
+		Path: path,
+	}
+	return h, nil
+}
+
+// RecipientStanza is a file key wrapped by a plugin, to be stored in
+// the age header.
+type RecipientStanza struct {
+	FileKeyIndex int
+	// Stanza holds the type, arguments and body of the age header
+	// stanza.
+	Stanza *Stanza
+}
+
+// FileKey is a file key unwrapped by a plugin.
+type FileKey struct {
+	FileKeyIndex int
+	Key          []byte
+}
+
+// PluginError is an error reported by the plugin with an error
+// stanza.
+type PluginError struct {
+	// Kind is what the error is about, such as "recipient" or
+	// "identity", or empty for errors not about a specific input.
+	Kind string
+	// Index is the 0-based index of the input of type Kind.
+	Index   int
+	Message string
+}
+
+func (e *PluginError) Error() string {
+	if e.Kind == "" {
+		return "plugin error: " + e.Message
+	}
+	return fmt.Sprintf("plugin error for %s %d: %s", e.Kind, e.Index, e.Message)
+}
+
+func parsePluginError(s *Stanza) (*PluginError, error) {
+	e := &PluginError{
+		Message: string(s.Body),
+	}
+	switch len(s.Args) {
+	case 0:
+	case 2:
+		idx, err := strconv.Atoi(s.Args[1])
+		if err != nil || idx < 0 {
+			return nil, fmt.Errorf("bad error index: %q", s.Args[1])
+		}
+		e.Kind = s.Args[0]
+		e.Index = idx
+	default:
+		return nil, fmt.Errorf("bad error arguments: %q", s.Args)
+	}
+	return e, nil
+}
+
+func (h *Host) run(mode string, fn func(conn *Conn) error) error {
+	cmd := exec.Command(h.Path, "--age-plugin="+mode)
+	cmd.Stderr = h.Stderr
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start plugin: %v", err)
+	}
+
+	// kill stops the plugin when giving up on it, so it is not
+	// left running
+	kill := func() {
+		_ = stdin.Close()
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}
+	conn := New(stdout, stdin)
+	if err := fn(conn); err != nil {
+		kill()
+		return err
+	}
+	if err := stdin.Close(); err != nil {
+		kill()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("plugin failed: %v", err)
+	}
+	return nil
+}
+
+// Wrap runs the plugin in mode recipient-v1, wrapping every file key
+// to every recipient.
+func (h *Host) Wrap(recipients []string, fileKeys [][]byte) ([]*RecipientStanza, []*PluginError, error) {
+	var (
+		stanzas    []*RecipientStanza
+		pluginErrs []*PluginError
+	)
+	err := h.run("recipient-v1", func(conn *Conn) error {
+		var err error
+		stanzas, pluginErrs, err = h.WrapConn(conn, recipients, fileKeys)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return stanzas, pluginErrs, nil
+}
+
+// WrapConn is like Wrap, but talks to an already running plugin over
+// conn.
+func (h *Host) WrapConn(conn *Conn, recipients []string, fileKeys [][]byte) ([]*RecipientStanza, []*PluginError, error) {
+	for _, recip := range recipients {
+		if err := conn.WriteStanza(&Stanza{
+			Type: "add-recipient",
+			Args: []string{recip},
+		}); err != nil {
+			return nil, nil, fmt.Errorf("writing add-recipient failed: %v", err)
+		}
+	}
+	for _, fileKey := range fileKeys {
+		if err := conn.WriteStanza(&Stanza{
+			Type: "wrap-file-key",
+			Body: fileKey,
+		}); err != nil {
+			return nil, nil, fmt.Errorf("writing wrap-file-key failed: %v", err)
+		}
+	}
+	if err := conn.WriteStanza(&Stanza{
+		Type: "done",
+	}); err != nil {
+		return nil, nil, fmt.Errorf("writing done failed: %v", err)
+	}
+
+	var (
+		stanzas    []*RecipientStanza
+		pluginErrs []*PluginError
+	)
+	for {
+		stanza, err := conn.ReadStanza()
+		if err != nil {
+			return nil, nil, fmt.Errorf("read error: %v", err)
+		}
+		switch stanza.Type {
+		case "recipient-stanza":
+			if len(stanza.Args) < 2 {
+				return nil, nil, fmt.Errorf("bad recipient-stanza arguments: %q", stanza.Args)
+			}
+			idx, err := strconv.Atoi(stanza.Args[0])
+			if err != nil || idx < 0 || idx >= len(fileKeys) {
+				return nil, nil, fmt.Errorf("bad recipient-stanza file key index: %q", stanza.Args[0])
+			}
+			stanzas = append(stanzas, &RecipientStanza{
+				FileKeyIndex: idx,
+				Stanza: &Stanza{
+					Type: stanza.Args[1],
+					Args: stanza.Args[2:],
+					Body: stanza.Body,
+				},
+			})
+			if err := writeOk(conn, "recipient-stanza"); err != nil {
+				return nil, nil, err
+			}
+		case "error":
+			e, err := parsePluginError(stanza)
+			if err != nil {
+				return nil, nil, err
+			}
+			pluginErrs = append(pluginErrs, e)
+			if err := writeOk(conn, "error"); err != nil {
+				return nil, nil, err
+			}
+		case "request-secret":
+			if err := h.answerSecret(conn, stanza); err != nil {
+				return nil, nil, err
+			}
+		case "msg":
+			if err := h.answerMessage(conn, stanza); err != nil {
+				return nil, nil, err
+			}
+		case "confirm":
+			if err := h.answerConfirm(conn, stanza); err != nil {
+				return nil, nil, err
+			}
+		case "done":
+			return stanzas, pluginErrs, nil
+		default:
+			if err := writeUnsupported(conn, stanza.Type); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// Unwrap runs the plugin in mode identity-v1, trying to unwrap the
+// stanzas with the identities.
+func (h *Host) Unwrap(identities []string, stanzas []*RecipientStanza) ([]*FileKey, []*PluginError, error) {
+	var (
+		fileKeys   []*FileKey
+		pluginErrs []*PluginError
+	)
+	err := h.run("identity-v1", func(conn *Conn) error {
+		var err error
+		fileKeys, pluginErrs, err = h.UnwrapConn(conn, identities, stanzas)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return fileKeys, pluginErrs, nil
+}
+
+// UnwrapConn is like Unwrap, but talks to an already running plugin
+// over conn.
+func (h *Host) UnwrapConn(conn *Conn, identities []string, stanzas []*RecipientStanza) ([]*FileKey, []*PluginError, error) {
+	for _, ident := range identities {
+		if err := conn.WriteStanza(&Stanza{
+			Type: "add-identity",
+			Args: []string{ident},
+		}); err != nil {
+			return nil, nil, fmt.Errorf("writing add-identity failed: %v", err)
+		}
+	}
+	for _, s := range stanzas {
+		args := make([]string, 0, 2+len(s.Stanza.Args))
+		args = append(args, strconv.Itoa(s.FileKeyIndex), s.Stanza.Type)
+		args = append(args, s.Stanza.Args...)
+		if err := conn.WriteStanza(&Stanza{
+			Type: "recipient-stanza",
+			Args: args,
+			Body: s.Stanza.Body,
+		}); err != nil {
+			return nil, nil, fmt.Errorf("writing recipient-stanza failed: %v", err)
+		}
+	}
+	if err := conn.WriteStanza(&Stanza{
+		Type: "done",
+	}); err != nil {
+		return nil, nil, fmt.Errorf("writing done failed: %v", err)
+	}
+
+	var (
+		fileKeys   []*FileKey
+		pluginErrs []*PluginError
+	)
+	for {
+		stanza, err := conn.ReadStanza()
+		if err != nil {
+			return nil, nil, fmt.Errorf("read error: %v", err)
+		}
+		switch stanza.Type {
+		case "file-key":
+			if len(stanza.Args) != 1 {
+				return nil, nil, fmt.Errorf("bad file-key arguments: %q", stanza.Args)
+			}
+			idx, err := strconv.Atoi(stanza.Args[0])
+			if err != nil || idx < 0 {
+				return nil, nil, fmt.Errorf("bad file-key index: %q", stanza.Args[0])
+			}
+			fileKeys = append(fileKeys, &FileKey{
+				FileKeyIndex: idx,
+				Key:          stanza.Body,
+			})
+			if err := writeOk(conn, "file-key"); err != nil {
+				return nil, nil, err
+			}
+		case "error":
+			e, err := parsePluginError(stanza)
+			if err != nil {
+				return nil, nil, err
+			}
+			pluginErrs = append(pluginErrs, e)
+			if err := writeOk(conn, "error"); err != nil {
+				return nil, nil, err
+			}
+		case "request-secret":
+			if err := h.answerSecret(conn, stanza); err != nil {
+				return nil, nil, err
+			}
+		case "msg":
+			if err := h.answerMessage(conn, stanza); err != nil {
+				return nil, nil, err
+			}
+		case "confirm":
+			if err := h.answerConfirm(conn, stanza); err != nil {
+				return nil, nil, err
+			}
+		case "done":
+			return fileKeys, pluginErrs, nil
+		default:
+			if err := writeUnsupported(conn, stanza.Type); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+}
+
+// writeOk acknowledges a phase 2 command that has no other answer.
+func writeOk(conn *Conn, command string) error {
+	if err := conn.WriteStanza(&Stanza{
+		Type: "ok",
+	}); err != nil {
+		return fmt.Errorf("writing %s response failed: %v", command, err)
+	}
+	return nil
+}
+
+// writeUnsupported answers a phase 2 command the host doesn't know,
+// so the plugin is not left waiting for a reply.
+func writeUnsupported(conn *Conn, command string) error {
+	if err := conn.WriteStanza(&Stanza{
+		Type: "unsupported",
+	}); err != nil {
+		return fmt.Errorf("writing %s response failed: %v", command, err)
+	}
+	return nil
+}
+
+var (
+	errNoSecrets = errors.New("secrets cannot be requested")
+	errNoConfirm = errors.New("confirmation cannot be requested")
+)
+
+func (h *Host) answerMessage(conn *Conn, msg *Stanza) error {
+	if h.DisplayMessage != nil {
+		if err := h.DisplayMessage(string(msg.Body)); err != nil {
+			return writeCallbackError(conn, "msg", err)
+		}
+	}
+	if err := conn.WriteStanza(&Stanza{
+		Type: "ok",
+	}); err != nil {
+		return fmt.Errorf("writing msg response failed: %v", err)
+	}
+	return nil
+}
+
+func (h *Host) answerConfirm(conn *Conn, req *Stanza) error {
+	var choices []string
+	if len(req.Args) < 1 || len(req.Args) > 2 {
+		return fmt.Errorf("bad confirm arguments: %q", req.Args)
+	}
+	for _, arg := range req.Args {
+		choice, err := base64.RawStdEncoding.Strict().DecodeString(arg)
+		if err != nil {
+			return fmt.Errorf("bad confirm choice: %v", err)
+		}
+		choices = append(choices, string(choice))
+	}
+	choices = append(choices, "")
+
+	yes, err := false, errNoConfirm
+	if h.Confirm != nil {
+		yes, err = h.Confirm(string(req.Body), choices[0], choices[1])
+	}
+	if err != nil {
+		return writeCallbackError(conn, "confirm", err)
+	}
+	answer := "no"
+	if yes {
+		answer = "yes"
+	}
+	if err := conn.WriteStanza(&Stanza{
+		Type: "ok",
+		Args: []string{answer},
+	}); err != nil {
+		return fmt.Errorf("writing confirm response failed: %v", err)
+	}
+	return nil
+}
+
+func writeCallbackError(conn *Conn, callback string, err error) error {
+	if err := conn.WriteStanza(&Stanza{
+		Type: "error",
+		Body: []byte(err.Error()),
+	}); err != nil {
+		return fmt.Errorf("writing %s error failed: %v", callback, err)
+	}
+	return nil
+}
+
+func (h *Host) answerSecret(conn *Conn, req *Stanza) error {
+	var (
+		secret string
+		err    = errNoSecrets
+	)
+	if h.RequestSecret != nil {
+		secret, err = h.RequestSecret(string(req.Body))
+	}
+	if err != nil {
+		return writeCallbackError(conn, "request-secret", err)
+	}
+	if err := conn.WriteStanza(&Stanza{
+		Type: "ok",
+		Body: []byte(secret),
+	}); err != nil {
+		return fmt.Errorf("writing request-secret response failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package ageplugin_test
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"eagain.net/go/yubage/internal/ageplugin"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakePlugin runs fn as the plugin side of a connection, returning
+// the host side.
+func fakePlugin(t *testing.T, fn func(conn *ageplugin.Conn) error) (*ageplugin.Conn, <-chan error) {
+	t.Helper()
+	hostR, pluginW := io.Pipe()
+	pluginR, hostW := io.Pipe()
+	errCh := make(chan error, 1)
+	go func() {
+		defer pluginR.Close()
+		defer pluginW.Close()
+		errCh <- fn(ageplugin.New(pluginR, pluginW))
+	}()
+	return ageplugin.New(hostR, hostW), errCh
+}
+
+func expectStanza(conn *ageplugin.Conn, want *ageplugin.Stanza) error {
+	got, err := conn.ReadStanza()
+	if err != nil {
+		return err
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		return errors.New("wrong stanza (-got +want)\n" + diff)
+	}
+	return nil
+}
+
+func TestHostWrapConn(t *testing.T) {
+	conn, errCh := fakePlugin(t, func(conn *ageplugin.Conn) error {
+		for _, want := range []*ageplugin.Stanza{
+			{Type: "add-recipient", Args: []string{"age1fake1"}, Body: []byte{}},
+			{Type: "wrap-file-key", Args: []string{}, Body: []byte("thud")},
+			{Type: "done", Args: []string{}, Body: []byte{}},
+		} {
+			if err := expectStanza(conn, want); err != nil {
+				return err
+			}
+		}
+		secret, err := conn.Prompt("password?")
+		if err != nil {
+			return err
+		}
+		for _, s := range []*ageplugin.Stanza{
+			{Type: "recipient-stanza", Args: []string{"0", "fake", secret}, Body: []byte("wrapped")},
+			{Type: "error", Args: []string{"recipient", "1"}, Body: []byte("nope")},
+		} {
+			if err := conn.WriteStanza(s); err != nil {
+				return err
+			}
+			if err := conn.ReadOk(); err != nil {
+				return err
+			}
+		}
+		return conn.WriteStanza(&ageplugin.Stanza{Type: "done"})
+	})
+
+	host := &ageplugin.Host{
+		RequestSecret: func(question string) (string, error) {
+			if question != "password?" {
+				t.Errorf("wrong question: %q", question)
+			}
+			return "hunter2", nil
+		},
+	}
+	stanzas, pluginErrs, err := host.WrapConn(conn, []string{"age1fake1"}, [][]byte{[]byte("thud")})
+	if err != nil {
+		t.Fatalf("WrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("plugin: %v", err)
+	}
+	wantStanzas := []*ageplugin.RecipientStanza{
+		{
+			FileKeyIndex: 0,
+			Stanza: &ageplugin.Stanza{
+				Type: "fake",
+				Args: []string{"hunter2"},
+				Body: []byte("wrapped"),
+			},
+		},
+	}
+	if diff := cmp.Diff(stanzas, wantStanzas); diff != "" {
+		t.Errorf("wrong stanzas (-got +want)\n%s", diff)
+	}
+	wantErrs := []*ageplugin.PluginError{
+		{Kind: "recipient", Index: 1, Message: "nope"},
+	}
+	if diff := cmp.Diff(pluginErrs, wantErrs); diff != "" {
+		t.Errorf("wrong errors (-got +want)\n%s", diff)
+	}
+}
+
+func TestHostUnwrapConn(t *testing.T) {
+	conn, errCh := fakePlugin(t, func(conn *ageplugin.Conn) error {
+		for _, want := range []*ageplugin.Stanza{
+			{Type: "add-identity", Args: []string{"AGE-PLUGIN-FAKE-1"}, Body: []byte{}},
+			{Type: "recipient-stanza", Args: []string{"0", "fake", "arg"}, Body: []byte("wrapped")},
+			{Type: "done", Args: []string{}, Body: []byte{}},
+		} {
+			if err := expectStanza(conn, want); err != nil {
+				return err
+			}
+		}
+		if _, err := conn.Prompt("PIN?"); err == nil {
+			return errors.New("expected refused request-secret")
+		}
+		if err := conn.WriteStanza(&ageplugin.Stanza{
+			Type: "file-key",
+			Args: []string{"0"},
+			Body: []byte("thud"),
+		}); err != nil {
+			return err
+		}
+		if err := conn.ReadOk(); err != nil {
+			return err
+		}
+		return conn.WriteStanza(&ageplugin.Stanza{Type: "done"})
+	})
+
+	host := &ageplugin.Host{}
+	stanzas := []*ageplugin.RecipientStanza{
+		{
+			FileKeyIndex: 0,
+			Stanza: &ageplugin.Stanza{
+				Type: "fake",
+				Args: []string{"arg"},
+				Body: []byte("wrapped"),
+			},
+		},
+	}
+	fileKeys, pluginErrs, err := host.UnwrapConn(conn, []string{"AGE-PLUGIN-FAKE-1"}, stanzas)
+	if err != nil {
+		t.Fatalf("UnwrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("plugin: %v", err)
+	}
+	want := []*ageplugin.FileKey{
+		{FileKeyIndex: 0, Key: []byte("thud")},
+	}
+	if diff := cmp.Diff(fileKeys, want); diff != "" {
+		t.Errorf("wrong file keys (-got +want)\n%s", diff)
+	}
+	if len(pluginErrs) != 0 {
+		t.Errorf("unexpected plugin errors: %v", pluginErrs)
+	}
+}
+
+func TestHostUnsupported(t *testing.T) {
+	host := &ageplugin.Host{}
+	for name, run := range map[string]func(conn *ageplugin.Conn) error{
+		"wrap": func(conn *ageplugin.Conn) error {
+			_, _, err := host.WrapConn(conn, nil, nil)
+			return err
+		},
+		"unwrap": func(conn *ageplugin.Conn) error {
+			_, _, err := host.UnwrapConn(conn, nil, nil)
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn, errCh := fakePlugin(t, func(conn *ageplugin.Conn) error {
+				for {
+					s, err := conn.ReadStanza()
+					if err != nil {
+						return err
+					}
+					if s.Type == "done" {
+						break
+					}
+				}
+				if err := conn.WriteStanza(&ageplugin.Stanza{Type: "frobnicate"}); err != nil {
+					return err
+				}
+				if err := expectStanza(conn, &ageplugin.Stanza{Type: "unsupported", Args: []string{}, Body: []byte{}}); err != nil {
+					return err
+				}
+				return conn.WriteStanza(&ageplugin.Stanza{Type: "done"})
+			})
+			if err := run(conn); err != nil {
+				t.Fatalf("host: %v", err)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatalf("plugin: %v", err)
+			}
+		})
+	}
+}
+
+func TestHostCallbacks(t *testing.T) {
+	conn, errCh := fakePlugin(t, func(conn *ageplugin.Conn) error {
+		for {
+			s, err := conn.ReadStanza()
+			if err != nil {
+				return err
+			}
+			if s.Type == "done" {
+				break
+			}
+		}
+		if err := conn.Message("touch it"); err != nil {
+			return err
+		}
+		yes, err := conn.Confirm("really?", "sure", "nope")
+		if err != nil {
+			return err
+		}
+		if !yes {
+			return errors.New("expected yes")
+		}
+		return conn.WriteStanza(&ageplugin.Stanza{Type: "done"})
+	})
+
+	var messages []string
+	host := &ageplugin.Host{
+		DisplayMessage: func(text string) error {
+			messages = append(messages, text)
+			return nil
+		},
+		Confirm: func(text string, yes string, no string) (bool, error) {
+			if text != "really?" || yes != "sure" || no != "nope" {
+				t.Errorf("wrong confirm: %q %q %q", text, yes, no)
+			}
+			return true, nil
+		},
+	}
+	if _, _, err := host.UnwrapConn(conn, nil, nil); err != nil {
+		t.Fatalf("UnwrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("plugin: %v", err)
+	}
+	if diff := cmp.Diff(messages, []string{"touch it"}); diff != "" {
+		t.Errorf("wrong messages (-got +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,430 @@
+package ageplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// RecipientPlugin is the plugin side of recipient-v1.
+type RecipientPlugin interface {
+	// ParseRecipient is called for every add-recipient. Errors are
+	// reported to the host as errors for that recipient.
+	ParseRecipient(recipient string) (Recipient, error)
+}
+
+// BatchRecipientPlugin is a RecipientPlugin that wraps all the file
+// keys to all the recipients in one go, for example to share work
+// between them.
+type BatchRecipientPlugin interface {
+	RecipientPlugin
+	// WrapBatch returns the stanzas by recipient, then file key, in
+	// the order given. An error is reported for every recipient.
+	WrapBatch(ctx context.Context, recipients []Recipient, fileKeys [][]byte) ([][]*Stanza, error)
+}
+
+// Recipient is a recipient accepted by a RecipientPlugin.
+type Recipient interface {
+	// Wrap encrypts the file key to the recipient. The stanza is
+	// stored in the age header as is.
+	Wrap(ctx context.Context, fileKey []byte) (*Stanza, error)
+}
+
+// IdentityPlugin is the plugin side of identity-v1. Identities and
+// stanzas are whatever the plugin returns from parsing them, handed
+// back to Unwrap.
+type IdentityPlugin interface {
+	// ParseIdentity is called for every add-identity. Errors are
+	// reported to the host as errors for that identity.
+	ParseIdentity(identity string) (interface{}, error)
+	// ParseStanza is called for every recipient-stanza. It returns
+	// nil for stanzas meant for someone else. Errors are reported
+	// as errors for that stanza.
+	ParseStanza(typ string, args []string, body []byte) (interface{}, error)
+	// Unwrap decrypts the file key in the stanza with the identity.
+	// It returns ErrNoMatch if the two don't belong together, and a
+	// *StanzaError if the stanza is at fault. Any other error is
+	// blamed on the identity, which is not used again.
+	Unwrap(ctx context.Context, ui *UI, identity interface{}, stanza interface{}) ([]byte, error)
+}
+
+// ErrNoMatch tells that an identity cannot decrypt a stanza, without
+// anything being wrong.
+var ErrNoMatch = errors.New("identity does not match stanza")
+
+// StanzaError blames an unwrap failure on the stanza, as opposed to
+// the identity.
+type StanzaError struct {
+	Err error
+}
+
+func (e *StanzaError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StanzaError) Unwrap() error {
+	return e.Err
+}
+
+// UI lets an IdentityPlugin talk to the user through the host.
+type UI struct {
+	ctx  context.Context
+	conn *Conn
+}
+
+// Prompt asks for a secret, such as a PIN.
+func (ui *UI) Prompt(question string) (string, error) {
+	return ui.conn.PromptContext(ui.ctx, question)
+}
+
+// Message shows a message, without waiting for an answer.
+func (ui *UI) Message(text string) error {
+	return ui.conn.MessageContext(ui.ctx, text)
+}
+
+// Confirm asks a question with the answers yes and no. See
+// Conn.Confirm.
+func (ui *UI) Confirm(text string, yes string, no string) (bool, error) {
+	return ui.conn.ConfirmContext(ui.ctx, text, yes, no)
+}
+
+func writeError(ctx context.Context, conn *Conn, kind string, idx int, err error) error {
+	if err := conn.WriteStanzaContext(ctx, &Stanza{
+		Type: "error",
+		Args: []string{kind, strconv.Itoa(idx)},
+		Body: []byte(err.Error()),
+	}); err != nil {
+		return fmt.Errorf("writing error response failed: %v", err)
+	}
+	if err := conn.ReadOkContext(ctx); err != nil {
+		return fmt.Errorf("error response: %v", err)
+	}
+	return nil
+}
+
+// readDone checks the stanza ending phase 1.
+func readDone(stanza *Stanza) error {
+	if len(stanza.Args) != 0 {
+		return errors.New("unexpected arguments in done stanza")
+	}
+	if len(stanza.Body) != 0 {
+		return errors.New("unexpected body in done stanza")
+	}
+	return nil
+}
+
+func writeDone(ctx context.Context, conn *Conn) error {
+	if err := conn.WriteStanzaContext(ctx, &Stanza{
+		Type: "done",
+	}); err != nil {
+		return fmt.Errorf("writing done failed: %v", err)
+	}
+	return nil
+}
+
+// fileKeySize is the size of every age file key.
+const fileKeySize = 16
+
+// ServeRecipient runs the recipient-v1 protocol on conn, until the
+// host is done.
+func ServeRecipient(ctx context.Context, conn *Conn, p RecipientPlugin) error {
+	var (
+		// these contain nil items for anything unrecognized, because
+		// we have to use original indexes in responses
+
+		recipients []Recipient
+		fileKeys   [][]byte
+
+		// errors to report once phase 1 is over, by index
+		recipientErrs = make(map[int]error)
+		fileKeyErrs   = make(map[int]error)
+	)
+
+loop:
+	for {
+		stanza, err := conn.ReadStanzaContext(ctx)
+		if err != nil {
+			return fmt.Errorf("read error: %v", err)
+		}
+		switch stanza.Type {
+		case "add-recipient":
+			// increase the count, no matter what
+			recipients = append(recipients, nil)
+			idx := len(recipients) - 1
+			if len(stanza.Args) != 1 || len(stanza.Body) != 0 {
+				recipientErrs[idx] = errors.New("malformed add-recipient")
+				continue
+			}
+			r, err := p.ParseRecipient(stanza.Args[0])
+			if err != nil {
+				recipientErrs[idx] = err
+				continue
+			}
+			recipients[idx] = r
+		case "wrap-file-key":
+			// increase the count, no matter what
+			fileKeys = append(fileKeys, nil)
+			idx := len(fileKeys) - 1
+			if len(stanza.Args) != 0 {
+				fileKeyErrs[idx] = errors.New("malformed wrap-file-key")
+				continue
+			}
+			if len(stanza.Body) != fileKeySize {
+				fileKeyErrs[idx] = fmt.Errorf("file key %d is %d bytes, not %d", idx, len(stanza.Body), fileKeySize)
+				continue
+			}
+			fileKeys[idx] = stanza.Body
+		case "done":
+			if err := readDone(stanza); err != nil {
+				return err
+			}
+			break loop
+		default:
+			// Phase 1 commands get no reply, not even
+			// unsupported; the host isn't reading yet.
+		}
+	}
+
+	wrap := func(recipIdx int, recip Recipient, keyIdx int) (*Stanza, error) {
+		return recip.Wrap(ctx, fileKeys[keyIdx])
+	}
+	if bp, ok := p.(BatchRecipientPlugin); ok {
+		wrap = batchWrap(ctx, bp, recipients, fileKeys)
+	}
+
+	for recipIdx, recip := range recipients {
+		if recip == nil {
+			if err := writeError(ctx, conn, "recipient", recipIdx, recipientErrs[recipIdx]); err != nil {
+				return err
+			}
+			continue
+		}
+		for keyIdx := range fileKeys {
+			if err, ok := fileKeyErrs[keyIdx]; ok {
+				// There is no error kind for file keys, so
+				// every recipient gets the blame.
+				if err := writeError(ctx, conn, "recipient", recipIdx, err); err != nil {
+					return err
+				}
+				continue
+			}
+			stanza, err := wrap(recipIdx, recip, keyIdx)
+			if err != nil {
+				if err := writeError(ctx, conn, "recipient", recipIdx, err); err != nil {
+					return err
+				}
+				continue
+			}
+			args := append([]string{strconv.Itoa(keyIdx), stanza.Type}, stanza.Args...)
+			if err := conn.WriteStanzaContext(ctx, &Stanza{
+				Type: "recipient-stanza",
+				Args: args,
+				Body: stanza.Body,
+			}); err != nil {
+				return fmt.Errorf("writing recipient-stanza failed: %v", err)
+			}
+			if err := conn.ReadOkContext(ctx); err != nil {
+				return fmt.Errorf("recipient-stanza error: %v", err)
+			}
+		}
+	}
+	return writeDone(ctx, conn)
+}
+
+// batchWrap wraps everything up front, and returns a function to
+// look up the results. Unrecognized recipients and malformed file
+// keys, which are nil, are left out of the batch.
+func batchWrap(ctx context.Context, p BatchRecipientPlugin, recipients []Recipient, fileKeys [][]byte) func(recipIdx int, recip Recipient, keyIdx int) (*Stanza, error) {
+	var (
+		batch      []Recipient
+		indexes    = make(map[int]int)
+		batchKeys  [][]byte
+		keyIndexes = make(map[int]int)
+	)
+	for i, r := range recipients {
+		if r != nil {
+			indexes[i] = len(batch)
+			batch = append(batch, r)
+		}
+	}
+	for i, k := range fileKeys {
+		if k != nil {
+			keyIndexes[i] = len(batchKeys)
+			batchKeys = append(batchKeys, k)
+		}
+	}
+	stanzas, err := p.WrapBatch(ctx, batch, batchKeys)
+	return func(recipIdx int, recip Recipient, keyIdx int) (*Stanza, error) {
+		if err != nil {
+			return nil, err
+		}
+		return stanzas[indexes[recipIdx]][keyIndexes[keyIdx]], nil
+	}
+}
+
+// identityStanza is a recipient-stanza recognized by the plugin.
+type identityStanza struct {
+	fileKeyIndex string
+	parsed       interface{}
+}
+
+// ServeIdentity runs the identity-v1 protocol on conn, until the host
+// is done. Each stanza is tried with the identities in order, until
+// one of them unwraps it, and stanzas for a file key already unwrapped
+// are skipped. An identity failing in Unwrap is reported only if it
+// could have helped with a file key that stayed locked.
+func ServeIdentity(ctx context.Context, conn *Conn, p IdentityPlugin) error {
+	var (
+		// these contain nil items for anything unrecognized, because
+		// we have to use original indexes in responses
+
+		identities []interface{}
+		stanzas    []*identityStanza
+
+		// errors to report once phase 1 is over, by index
+		identityErrs = make(map[int]error)
+		stanzaErrs   = make(map[int]error)
+	)
+
+loop:
+	for {
+		stanza, err := conn.ReadStanzaContext(ctx)
+		if err != nil {
+			return fmt.Errorf("receive error: %v", err)
+		}
+		switch stanza.Type {
+		case "add-identity":
+			// increase the count, no matter what
+			identities = append(identities, nil)
+			idx := len(identities) - 1
+			if len(stanza.Args) != 1 || len(stanza.Body) != 0 {
+				identityErrs[idx] = errors.New("malformed add-identity")
+				continue
+			}
+			id, err := p.ParseIdentity(stanza.Args[0])
+			if err != nil {
+				identityErrs[idx] = err
+				continue
+			}
+			identities[idx] = id
+		case "recipient-stanza":
+			// increase the count, no matter what
+			stanzas = append(stanzas, nil)
+			idx := len(stanzas) - 1
+			if len(stanza.Args) < 2 {
+				stanzaErrs[idx] = errors.New("malformed recipient-stanza")
+				continue
+			}
+			parsed, err := p.ParseStanza(stanza.Args[1], stanza.Args[2:], stanza.Body)
+			if err != nil {
+				stanzaErrs[idx] = err
+				continue
+			}
+			if parsed == nil {
+				continue
+			}
+			stanzas[idx] = &identityStanza{
+				fileKeyIndex: stanza.Args[0],
+				parsed:       parsed,
+			}
+		case "done":
+			if err := readDone(stanza); err != nil {
+				return err
+			}
+			break loop
+		default:
+			// Phase 1 commands get no reply, not even
+			// unsupported; the host isn't reading yet.
+		}
+	}
+
+	for idx := range identities {
+		if err, ok := identityErrs[idx]; ok {
+			if err := writeError(ctx, conn, "identity", idx, err); err != nil {
+				return err
+			}
+		}
+	}
+	for idx := range stanzas {
+		if err, ok := stanzaErrs[idx]; ok {
+			if err := writeError(ctx, conn, "stanza", idx, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	ui := &UI{ctx: ctx, conn: conn}
+	var (
+		// file key indexes that have been unwrapped
+		unwrapped = make(map[string]bool)
+		// identities that failed in Unwrap, and the file key
+		// indexes they then could not help with
+		unwrapErrs = make(map[int]error)
+		missed     = make(map[int]map[string]bool)
+	)
+	for stanzaIdx, stanza := range stanzas {
+		if stanza == nil || unwrapped[stanza.fileKeyIndex] {
+			continue
+		}
+		for identIdx, ident := range identities {
+			if ident == nil {
+				continue
+			}
+			if _, failed := unwrapErrs[identIdx]; failed {
+				// Don't burn PIN attempts, or keep complaining
+				// about the same missing card.
+				missed[identIdx][stanza.fileKeyIndex] = true
+				continue
+			}
+
+			fileKey, err := p.Unwrap(ctx, ui, ident, stanza.parsed)
+			if err == ErrNoMatch {
+				continue
+			}
+			var stanzaErr *StanzaError
+			if errors.As(err, &stanzaErr) {
+				if err := writeError(ctx, conn, "stanza", stanzaIdx, stanzaErr.Err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil {
+				unwrapErrs[identIdx] = err
+				missed[identIdx] = map[string]bool{stanza.fileKeyIndex: true}
+				continue
+			}
+
+			if err := conn.WriteStanzaContext(ctx, &Stanza{
+				Type: "file-key",
+				Args: []string{stanza.fileKeyIndex},
+				Body: fileKey,
+			}); err != nil {
+				return fmt.Errorf("writing file-key response failed: %v", err)
+			}
+			if err := conn.ReadOkContext(ctx); err != nil {
+				return fmt.Errorf("file-key error: %v", err)
+			}
+			unwrapped[stanza.fileKeyIndex] = true
+			break
+		}
+	}
+
+	// A missing card is no news if another identity unwrapped
+	// everything it could have.
+	for identIdx := range identities {
+		err, ok := unwrapErrs[identIdx]
+		if !ok {
+			continue
+		}
+		for fileKeyIdx := range missed[identIdx] {
+			if !unwrapped[fileKeyIdx] {
+				if err := writeError(ctx, conn, "identity", identIdx, err); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return writeDone(ctx, conn)
+}
@@ -0,0 +1,322 @@
+package ageplugin_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"eagain.net/go/yubage/internal/ageplugin"
+	"github.com/google/go-cmp/cmp"
+)
+
+// toyPlugin "encrypts" by reversing the file key, and tags stanzas
+// with the name of the recipient.
+type toyPlugin struct {
+	prompts int
+}
+
+type toyRecipient string
+
+func (r toyRecipient) Wrap(ctx context.Context, fileKey []byte) (*ageplugin.Stanza, error) {
+	if r == "fail" {
+		return nil, errors.New("cannot wrap")
+	}
+	s := &ageplugin.Stanza{
+		Type: "toy",
+		Args: []string{string(r)},
+		Body: reverse(fileKey),
+	}
+	return s, nil
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func (p *toyPlugin) ParseRecipient(recipient string) (ageplugin.Recipient, error) {
+	if !strings.HasPrefix(recipient, "toy-") {
+		return nil, errors.New("not a toy recipient")
+	}
+	return toyRecipient(strings.TrimPrefix(recipient, "toy-")), nil
+}
+
+func (p *toyPlugin) ParseIdentity(identity string) (interface{}, error) {
+	if !strings.HasPrefix(identity, "TOY-") {
+		return nil, errors.New("not a toy identity")
+	}
+	return strings.ToLower(strings.TrimPrefix(identity, "TOY-")), nil
+}
+
+func (p *toyPlugin) ParseStanza(typ string, args []string, body []byte) (interface{}, error) {
+	if typ != "toy" {
+		return nil, nil
+	}
+	if len(args) != 1 {
+		return nil, errors.New("malformed toy stanza")
+	}
+	return &ageplugin.Stanza{Type: typ, Args: args, Body: body}, nil
+}
+
+func (p *toyPlugin) Unwrap(ctx context.Context, ui *ageplugin.UI, identity interface{}, stanza interface{}) ([]byte, error) {
+	name := identity.(string)
+	s := stanza.(*ageplugin.Stanza)
+	if s.Args[0] != name {
+		return nil, ageplugin.ErrNoMatch
+	}
+	if name == "locked" {
+		return nil, errors.New("identity is locked")
+	}
+	if len(s.Body) != 16 {
+		return nil, &ageplugin.StanzaError{Err: errors.New("bad file key length")}
+	}
+	if _, err := ui.Prompt("password?"); err != nil {
+		return nil, err
+	}
+	p.prompts++
+	return reverse(s.Body), nil
+}
+
+func TestServeRecipient(t *testing.T) {
+	conn, errCh := fakePlugin(t, func(conn *ageplugin.Conn) error {
+		return ageplugin.ServeRecipient(context.Background(), conn, &toyPlugin{})
+	})
+	host := &ageplugin.Host{}
+	fileKeys := [][]byte{[]byte("0123456789abcdef"), []byte("fedcba9876543210")}
+	stanzas, pluginErrs, err := host.WrapConn(conn, []string{"toy-alice", "bogus", "toy-fail"}, fileKeys)
+	if err != nil {
+		t.Fatalf("WrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("ServeRecipient: %v", err)
+	}
+	wantStanzas := []*ageplugin.RecipientStanza{
+		{FileKeyIndex: 0, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"alice"}, Body: []byte("fedcba9876543210")}},
+		{FileKeyIndex: 1, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"alice"}, Body: []byte("0123456789abcdef")}},
+	}
+	if diff := cmp.Diff(stanzas, wantStanzas); diff != "" {
+		t.Errorf("wrong stanzas (-got +want)\n%s", diff)
+	}
+	wantErrs := []*ageplugin.PluginError{
+		{Kind: "recipient", Index: 1, Message: "not a toy recipient"},
+		{Kind: "recipient", Index: 2, Message: "cannot wrap"},
+		{Kind: "recipient", Index: 2, Message: "cannot wrap"},
+	}
+	if diff := cmp.Diff(pluginErrs, wantErrs); diff != "" {
+		t.Errorf("wrong errors (-got +want)\n%s", diff)
+	}
+}
+
+// toyBatchPlugin wraps in batches, remembering what it was given.
+type toyBatchPlugin struct {
+	toyPlugin
+	batches [][]ageplugin.Recipient
+}
+
+func (p *toyBatchPlugin) WrapBatch(ctx context.Context, recipients []ageplugin.Recipient, fileKeys [][]byte) ([][]*ageplugin.Stanza, error) {
+	p.batches = append(p.batches, recipients)
+	result := make([][]*ageplugin.Stanza, len(recipients))
+	for i, r := range recipients {
+		for _, fileKey := range fileKeys {
+			s, err := r.Wrap(ctx, fileKey)
+			if err != nil {
+				return nil, err
+			}
+			s.Args = append(s.Args, "batch")
+			result[i] = append(result[i], s)
+		}
+	}
+	return result, nil
+}
+
+func TestServeRecipientBatch(t *testing.T) {
+	plugin := &toyBatchPlugin{}
+	conn, errCh := fakePlugin(t, func(conn *ageplugin.Conn) error {
+		return ageplugin.ServeRecipient(context.Background(), conn, plugin)
+	})
+	host := &ageplugin.Host{}
+	fileKeys := [][]byte{[]byte("0123456789abcdef"), []byte("fedcba9876543210")}
+	stanzas, pluginErrs, err := host.WrapConn(conn, []string{"toy-alice", "bogus", "toy-bob"}, fileKeys)
+	if err != nil {
+		t.Fatalf("WrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("ServeRecipient: %v", err)
+	}
+	wantStanzas := []*ageplugin.RecipientStanza{
+		{FileKeyIndex: 0, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"alice", "batch"}, Body: []byte("fedcba9876543210")}},
+		{FileKeyIndex: 1, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"alice", "batch"}, Body: []byte("0123456789abcdef")}},
+		{FileKeyIndex: 0, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"bob", "batch"}, Body: []byte("fedcba9876543210")}},
+		{FileKeyIndex: 1, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"bob", "batch"}, Body: []byte("0123456789abcdef")}},
+	}
+	if diff := cmp.Diff(stanzas, wantStanzas); diff != "" {
+		t.Errorf("wrong stanzas (-got +want)\n%s", diff)
+	}
+	wantErrs := []*ageplugin.PluginError{
+		{Kind: "recipient", Index: 1, Message: "not a toy recipient"},
+	}
+	if diff := cmp.Diff(pluginErrs, wantErrs); diff != "" {
+		t.Errorf("wrong errors (-got +want)\n%s", diff)
+	}
+	wantBatches := [][]ageplugin.Recipient{{toyRecipient("alice"), toyRecipient("bob")}}
+	if diff := cmp.Diff(plugin.batches, wantBatches); diff != "" {
+		t.Errorf("wrong batches (-got +want)\n%s", diff)
+	}
+}
+
+func TestServeIdentity(t *testing.T) {
+	plugin := &toyPlugin{}
+	conn, errCh := fakePlugin(t, func(conn *ageplugin.Conn) error {
+		return ageplugin.ServeIdentity(context.Background(), conn, plugin)
+	})
+	host := &ageplugin.Host{
+		RequestSecret: func(string) (string, error) {
+			return "hunter2", nil
+		},
+	}
+	stanzas := []*ageplugin.RecipientStanza{
+		{FileKeyIndex: 0, Stanza: &ageplugin.Stanza{Type: "X25519", Args: []string{"noise"}, Body: []byte("noise")}},
+		{FileKeyIndex: 0, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"bob", "extra"}}},
+		{FileKeyIndex: 0, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"locked"}, Body: []byte("fedcba9876543210")}},
+		{FileKeyIndex: 0, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"alice"}, Body: []byte("short")}},
+		{FileKeyIndex: 0, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"alice"}, Body: []byte("fedcba9876543210")}},
+		// already unwrapped, not even tried
+		{FileKeyIndex: 0, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"alice"}, Body: []byte("fedcba9876543210")}},
+		{FileKeyIndex: 1, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"alice"}, Body: []byte("0123456789abcdef")}},
+		// only the locked identity could have opened this one
+		{FileKeyIndex: 2, Stanza: &ageplugin.Stanza{Type: "toy", Args: []string{"locked"}, Body: []byte("fedcba9876543210")}},
+	}
+	fileKeys, pluginErrs, err := host.UnwrapConn(conn, []string{"bogus", "TOY-LOCKED", "TOY-ALICE"}, stanzas)
+	if err != nil {
+		t.Fatalf("UnwrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("ServeIdentity: %v", err)
+	}
+	wantKeys := []*ageplugin.FileKey{
+		{FileKeyIndex: 0, Key: []byte("0123456789abcdef")},
+		{FileKeyIndex: 1, Key: []byte("fedcba9876543210")},
+	}
+	if diff := cmp.Diff(fileKeys, wantKeys); diff != "" {
+		t.Errorf("wrong file keys (-got +want)\n%s", diff)
+	}
+	wantErrs := []*ageplugin.PluginError{
+		{Kind: "identity", Index: 0, Message: "not a toy identity"},
+		{Kind: "stanza", Index: 1, Message: "malformed toy stanza"},
+		{Kind: "stanza", Index: 3, Message: "bad file key length"},
+		{Kind: "identity", Index: 1, Message: "identity is locked"},
+	}
+	if diff := cmp.Diff(pluginErrs, wantErrs); diff != "" {
+		t.Errorf("wrong errors (-got +want)\n%s", diff)
+	}
+	if plugin.prompts != 2 {
+		t.Errorf("wrong number of prompts: %d", plugin.prompts)
+	}
+}
+
+func TestServeIdentityBadDone(t *testing.T) {
+	in := bytes.NewBufferString("-> done extra\n\n")
+	conn := ageplugin.New(in, new(bytes.Buffer))
+	if err := ageplugin.ServeIdentity(context.Background(), conn, &toyPlugin{}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+// chat runs serve with the input stanzas, each followed by an empty
+// line, and then n ok replies. It returns the type and arguments of
+// the stanzas written by serve.
+func chat(t *testing.T, serve func(conn *ageplugin.Conn) error, input []*ageplugin.Stanza, n int) []string {
+	t.Helper()
+	in := new(bytes.Buffer)
+	host := ageplugin.New(nil, in)
+	for _, s := range input {
+		if err := host.WriteStanza(s); err != nil {
+			t.Fatalf("writing input: %v", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if err := host.WriteStanza(&ageplugin.Stanza{Type: "ok"}); err != nil {
+			t.Fatalf("writing input: %v", err)
+		}
+	}
+	out := new(bytes.Buffer)
+	if err := serve(ageplugin.New(in, out)); err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	if in.Len() != 0 {
+		t.Errorf("unconsumed input:\n%s", in.Bytes())
+	}
+	var got []string
+	replies := ageplugin.New(out, nil)
+	for len(got) == 0 || got[len(got)-1] != "done" {
+		s, err := replies.ReadStanza()
+		if err != nil {
+			t.Fatalf("bad output: %v", err)
+		}
+		got = append(got, strings.Join(append([]string{s.Type}, s.Args...), " "))
+	}
+	return got
+}
+
+func TestServeRecipientMalformedFileKey(t *testing.T) {
+	got := chat(t, func(conn *ageplugin.Conn) error {
+		return ageplugin.ServeRecipient(context.Background(), conn, &toyPlugin{})
+	}, []*ageplugin.Stanza{
+		{Type: "add-recipient", Args: []string{"toy-alice"}},
+		{Type: "wrap-file-key", Args: []string{"extra"}, Body: []byte("0123456789abcdef")},
+		{Type: "wrap-file-key", Body: []byte("short")},
+		{Type: "wrap-file-key", Body: []byte("0123456789abcdef")},
+		{Type: "done"},
+	}, 3)
+	want := []string{
+		"error recipient 0",
+		"error recipient 0",
+		"recipient-stanza 2 toy alice",
+		"done",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected output (-got +want):\n%s", diff)
+	}
+}
+
+func TestServeRecipientBatchMalformedFileKey(t *testing.T) {
+	plugin := &toyBatchPlugin{}
+	got := chat(t, func(conn *ageplugin.Conn) error {
+		return ageplugin.ServeRecipient(context.Background(), conn, plugin)
+	}, []*ageplugin.Stanza{
+		{Type: "add-recipient", Args: []string{"toy-alice"}},
+		{Type: "wrap-file-key", Body: []byte("short")},
+		{Type: "wrap-file-key", Body: []byte("0123456789abcdef")},
+		{Type: "done"},
+	}, 2)
+	want := []string{
+		"error recipient 0",
+		"recipient-stanza 1 toy alice batch",
+		"done",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected output (-got +want):\n%s", diff)
+	}
+}
+
+func TestServeIdentityMalformedStanza(t *testing.T) {
+	got := chat(t, func(conn *ageplugin.Conn) error {
+		return ageplugin.ServeIdentity(context.Background(), conn, &toyPlugin{})
+	}, []*ageplugin.Stanza{
+		{Type: "add-identity", Args: []string{"TOY-ALICE"}},
+		{Type: "recipient-stanza", Args: []string{"0"}, Body: []byte("fedcba9876543210")},
+		{Type: "done"},
+	}, 1)
+	want := []string{
+		"error stanza 0",
+		"done",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected output (-got +want):\n%s", diff)
+	}
+}
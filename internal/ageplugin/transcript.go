@@ -0,0 +1,183 @@
+package ageplugin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Directions of stanzas in a transcript, as seen from the side doing
+// the recording.
+const (
+	TranscriptIn  = "in"
+	TranscriptOut = "out"
+)
+
+// TranscriptEntry is one stanza in a transcript. Transcripts are
+// stored as one JSON object per line.
+type TranscriptEntry struct {
+	Dir  string   `json:"dir"`
+	Type string   `json:"type"`
+	Args []string `json:"args,omitempty"`
+	Body []byte   `json:"body,omitempty"`
+	// Redacted is set when the body was left out, and BodyLength
+	// tells how long it was.
+	Redacted   bool `json:"redacted,omitempty"`
+	BodyLength int  `json:"bodyLength,omitempty"`
+}
+
+// secretBodies are the stanza types whose bodies are redacted from
+// transcripts by default: file keys, wrapped file keys, and answers
+// such as PINs.
+var secretBodies = map[string]bool{
+	"wrap-file-key":    true,
+	"file-key":         true,
+	"recipient-stanza": true,
+	"ok":               true,
+}
+
+// Transcript records every stanza exchanged on a Conn, for debugging
+// interoperability problems.
+type Transcript struct {
+	mu         sync.Mutex
+	w          io.Writer
+	unredacted bool
+}
+
+// NewTranscript returns a transcript writing to w. Secrets are left
+// out, unless unredacted is set.
+func NewTranscript(w io.Writer, unredacted bool) *Transcript {
+	t := &Transcript{
+		w:          w,
+		unredacted: unredacted,
+	}
+	return t
+}
+
+// SetTranscript makes conn record all stanzas read and written from
+// now on to t.
+func (conn *Conn) SetTranscript(t *Transcript) {
+	conn.transcript = t
+}
+
+func (t *Transcript) write(e *TranscriptEntry) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		// cannot happen with these types
+		panic(fmt.Sprintf("cannot marshal transcript entry: %v", err))
+	}
+	buf = append(buf, '\n')
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.w.Write(buf); err != nil {
+		// the transcript is a debugging aid, don't break the
+		// actual protocol because of it
+		debugf("cannot write transcript: %v", err)
+	}
+}
+
+// recording collects the body of one stanza for the transcript. Nil
+// means not recording.
+type recording struct {
+	t     *Transcript
+	entry TranscriptEntry
+	body  bytes.Buffer
+}
+
+func (t *Transcript) start(dir string, typ string, args []string) *recording {
+	if t == nil {
+		return nil
+	}
+	r := &recording{
+		t: t,
+		entry: TranscriptEntry{
+			Dir:  dir,
+			Type: typ,
+			Args: args,
+		},
+	}
+	return r
+}
+
+func (r *recording) add(p []byte) {
+	if r == nil {
+		return
+	}
+	_, _ = r.body.Write(p)
+}
+
+func (r *recording) finish() {
+	if r == nil {
+		return
+	}
+	e := r.entry
+	if r.body.Len() > 0 {
+		if secretBodies[e.Type] && !r.t.unredacted {
+			e.Redacted = true
+			e.BodyLength = r.body.Len()
+		} else {
+			e.Body = r.body.Bytes()
+		}
+	}
+	r.t.write(&e)
+}
+
+// ReadTranscript parses a transcript written by Transcript.
+func ReadTranscript(r io.Reader) ([]*TranscriptEntry, error) {
+	var entries []*TranscriptEntry
+	scanner := bufio.NewScanner(r)
+	// bodies can be big
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var e TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("cannot parse transcript entry %d: %v", len(entries), err)
+		}
+		if e.Dir != TranscriptIn && e.Dir != TranscriptOut {
+			return nil, fmt.Errorf("transcript entry %d has unknown direction: %q", len(entries), e.Dir)
+		}
+		entries = append(entries, &e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read transcript: %v", err)
+	}
+	return entries, nil
+}
+
+// ReplayInput reconstructs the input the recording side received, for
+// feeding it to a plugin again. Redacted bodies are replaced by the
+// result of fill, or by zero bytes if fill is or returns nil.
+func ReplayInput(entries []*TranscriptEntry, fill func(e *TranscriptEntry) []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	conn := New(new(bytes.Buffer), buf)
+	for _, e := range entries {
+		if e.Dir != TranscriptIn {
+			continue
+		}
+		body := e.Body
+		if e.Redacted {
+			body = nil
+			if fill != nil {
+				body = fill(e)
+			}
+			if body == nil {
+				body = make([]byte, e.BodyLength)
+			}
+		}
+		if err := conn.WriteStanza(&Stanza{
+			Type: e.Type,
+			Args: e.Args,
+			Body: body,
+		}); err != nil {
+			return nil, fmt.Errorf("cannot replay %s stanza: %v", e.Type, err)
+		}
+	}
+	if buf.Len() == 0 {
+		return nil, errors.New("transcript has no input")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,82 @@
+package ageplugin_test
+
+import (
+	"bytes"
+	"testing"
+
+	"eagain.net/go/yubage/internal/ageplugin"
+	"github.com/google/go-cmp/cmp"
+)
+
+func recordChat(t *testing.T, unredacted bool) []*ageplugin.TranscriptEntry {
+	t.Helper()
+	in := new(bytes.Buffer)
+	out := new(bytes.Buffer)
+	in.WriteString("-> add-recipient age1foo\n\n-> wrap-file-key\nMDEyMzQ1Njc4OWFiY2RlZg\n-> ok\nMTIzNDU2\n")
+	conn := ageplugin.New(in, out)
+	transcript := new(bytes.Buffer)
+	conn.SetTranscript(ageplugin.NewTranscript(transcript, unredacted))
+
+	for i := 0; i < 2; i++ {
+		if _, err := conn.ReadStanza(); err != nil {
+			t.Fatalf("ReadStanza: %v", err)
+		}
+	}
+	if _, err := conn.Prompt("PIN?"); err != nil {
+		t.Fatalf("Prompt: %v", err)
+	}
+	if err := conn.WriteStanza(&ageplugin.Stanza{
+		Type: "recipient-stanza",
+		Args: []string{"0", "foo"},
+		Body: []byte("wrapped"),
+	}); err != nil {
+		t.Fatalf("WriteStanza: %v", err)
+	}
+
+	entries, err := ageplugin.ReadTranscript(transcript)
+	if err != nil {
+		t.Fatalf("ReadTranscript: %v", err)
+	}
+	return entries
+}
+
+func TestTranscriptRedacted(t *testing.T) {
+	got := recordChat(t, false)
+	want := []*ageplugin.TranscriptEntry{
+		{Dir: "in", Type: "add-recipient", Args: []string{"age1foo"}},
+		{Dir: "in", Type: "wrap-file-key", Redacted: true, BodyLength: 16},
+		{Dir: "out", Type: "request-secret", Body: []byte("PIN?")},
+		{Dir: "in", Type: "ok", Redacted: true, BodyLength: 6},
+		{Dir: "out", Type: "recipient-stanza", Args: []string{"0", "foo"}, Redacted: true, BodyLength: 7},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong transcript (-got +want)\n%s", diff)
+	}
+}
+
+func TestTranscriptUnredacted(t *testing.T) {
+	got := recordChat(t, true)
+	if g, e := string(got[1].Body), "0123456789abcdef"; g != e {
+		t.Errorf("wrong file key: %q != %q", g, e)
+	}
+	if g, e := string(got[3].Body), "123456"; g != e {
+		t.Errorf("wrong PIN: %q != %q", g, e)
+	}
+}
+
+func TestReplayInput(t *testing.T) {
+	entries := recordChat(t, false)
+	input, err := ageplugin.ReplayInput(entries, func(e *ageplugin.TranscriptEntry) []byte {
+		if e.Type == "ok" {
+			return []byte("654321")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReplayInput: %v", err)
+	}
+	want := "-> add-recipient age1foo\n\n-> wrap-file-key\nAAAAAAAAAAAAAAAAAAAAAA\n-> ok\nNjU0MzIx\n"
+	if diff := cmp.Diff(string(input), want); diff != "" {
+		t.Errorf("wrong input (-got +want)\n%s", diff)
+	}
+}
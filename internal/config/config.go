@@ -0,0 +1,201 @@
+// Package config reads the per-user configuration file of
+// age-plugin-yubikey.
+//
+// The file is line oriented. Empty lines and lines starting with #
+// are ignored, the rest are a keyword followed by its arguments:
+//
+//	# shown in PIN and touch prompts
+//	name 12345678 work
+//	# only use readers whose name contains this, can be repeated
+//	reader Yubico YubiKey
+//	# let PIN policy "once" cover the rest of a plugin run, default yes
+//	pin-cache no
+//	# ask yubikey-agent and such to let go of the card, default no
+//	release-agents yes
+//	# short name for a recipient
+//	alias work age1yubikey1...
+//	# recipient bundle from the verify and bundle commands, can be
+//	# repeated
+//	bundle /home/me/team/alice.bundle
+//	# refuse to encrypt to recipients without a bundle, default no
+//	require-attestation yes
+//	# where log messages go, unless YUBAGE_LOG is set
+//	log stderr,journald
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Config is the content of the configuration file.
+type Config struct {
+	// Names are friendly names for cards, by serial number.
+	Names map[uint32]string
+	// Readers limits the PC/SC readers used to the ones whose name
+	// contains one of these, ignoring case. Empty means all.
+	Readers []string
+	// NoPINCache closes cards after each use, so the PIN is asked
+	// every time also with the PIN policy "once".
+	NoPINCache bool
+	// ReleaseAgents allows asking other programs holding a card,
+	// such as yubikey-agent, to let go of it.
+	ReleaseAgents bool
+	// Aliases maps short names to recipient strings.
+	Aliases map[string]string
+	// Bundles are paths of recipient bundle files.
+	Bundles []string
+	// RequireAttestation refuses to encrypt to recipients that
+	// have no bundle.
+	RequireAttestation bool
+	// Log is the comma-separated list of log destinations, as in
+	// YUBAGE_LOG. Empty means the default.
+	Log string
+}
+
+// DefaultPath returns where the configuration file is, following the
+// XDG base directory conventions on all platforms.
+func DefaultPath() (string, error) {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("cannot find configuration: %v", err)
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "age-plugin-yubikey", "config"), nil
+}
+
+// Load reads the configuration file at path. A missing file is the
+// same as an empty one.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read configuration: %v", err)
+	}
+	defer f.Close()
+	conf, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return conf, nil
+}
+
+// Parse parses a configuration file. Errors start with the line
+// number.
+func Parse(r io.Reader) (*Config, error) {
+	conf := &Config{}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := conf.parseLine(line); err != nil {
+			return nil, fmt.Errorf("%d: %v", lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (c *Config) parseLine(line string) error {
+	fields := strings.Fields(line)
+	keyword := fields[0]
+	// the rest of the line, for values that may contain spaces
+	rest := strings.TrimSpace(strings.TrimPrefix(line, keyword))
+	switch keyword {
+	case "name":
+		if len(fields) < 3 {
+			return errors.New("usage: name SERIAL NAME")
+		}
+		serial, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("bad serial number: %q", fields[1])
+		}
+		if c.Names == nil {
+			c.Names = make(map[uint32]string)
+		}
+		c.Names[uint32(serial)] = strings.TrimSpace(strings.TrimPrefix(rest, fields[1]))
+	case "reader":
+		if rest == "" {
+			return errors.New("usage: reader NAME")
+		}
+		c.Readers = append(c.Readers, rest)
+	case "pin-cache":
+		v, err := parseYesNo(keyword, fields)
+		if err != nil {
+			return err
+		}
+		c.NoPINCache = !v
+	case "release-agents":
+		v, err := parseYesNo(keyword, fields)
+		if err != nil {
+			return err
+		}
+		c.ReleaseAgents = v
+	case "alias":
+		if len(fields) != 3 {
+			return errors.New("usage: alias NAME RECIPIENT")
+		}
+		if c.Aliases == nil {
+			c.Aliases = make(map[string]string)
+		}
+		c.Aliases[fields[1]] = fields[2]
+	case "bundle":
+		if rest == "" {
+			return errors.New("usage: bundle PATH")
+		}
+		c.Bundles = append(c.Bundles, rest)
+	case "require-attestation":
+		v, err := parseYesNo(keyword, fields)
+		if err != nil {
+			return err
+		}
+		c.RequireAttestation = v
+	case "log":
+		if rest == "" {
+			return errors.New("usage: log DESTINATION[,DESTINATION]...")
+		}
+		c.Log = rest
+	default:
+		return fmt.Errorf("unknown keyword: %q", keyword)
+	}
+	return nil
+}
+
+func parseYesNo(keyword string, fields []string) (bool, error) {
+	if len(fields) != 2 {
+		return false, fmt.Errorf("usage: %s yes|no", keyword)
+	}
+	switch fields[1] {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s must be yes or no: %q", keyword, fields[1])
+}
+
+// Recipient returns the recipient that s is an alias for, or s
+// itself if it is not an alias.
+func (c *Config) Recipient(s string) string {
+	if r, ok := c.Aliases[s]; ok {
+		return r
+	}
+	return s
+}
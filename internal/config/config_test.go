@@ -0,0 +1,82 @@
+package config_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"eagain.net/go/yubage/internal/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	const input = `# comment
+
+name 12345678 work key
+reader Yubico YubiKey
+reader Nitrokey
+pin-cache no
+release-agents yes
+alias me age1yubikey1qwerty
+bundle /team/alice smith.bundle
+require-attestation yes
+log stderr,file:/tmp/yubage.log
+`
+	conf, err := config.Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	want := &config.Config{
+		Names:              map[uint32]string{12345678: "work key"},
+		Readers:            []string{"Yubico YubiKey", "Nitrokey"},
+		NoPINCache:         true,
+		ReleaseAgents:      true,
+		Aliases:            map[string]string{"me": "age1yubikey1qwerty"},
+		Bundles:            []string{"/team/alice smith.bundle"},
+		RequireAttestation: true,
+		Log:                "stderr,file:/tmp/yubage.log",
+	}
+	if diff := cmp.Diff(conf, want); diff != "" {
+		t.Errorf("wrong config (-got +want):\n%s", diff)
+	}
+	if g, e := conf.Recipient("me"), "age1yubikey1qwerty"; g != e {
+		t.Errorf("alias not expanded: %q", g)
+	}
+	if g, e := conf.Recipient("age1yubikey1other"), "age1yubikey1other"; g != e {
+		t.Errorf("non-alias changed: %q", g)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, input := range []string{
+		"bogus 1\n",
+		"name xyz work\n",
+		"name 1\n",
+		"pin-cache maybe\n",
+		"release-agents\n",
+		"alias me\n",
+		"reader\n",
+		"bundle\n",
+		"require-attestation 1\n",
+		"log\n",
+	} {
+		_, err := config.Parse(strings.NewReader("# ok\n" + input))
+		if err == nil {
+			t.Errorf("expected an error for %q", input)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "2: ") {
+			t.Errorf("error does not have line number: %v", err)
+		}
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	conf, err := config.Load(filepath.Join(t.TempDir(), "config"))
+	if err != nil {
+		t.Fatalf("missing file is an error: %v", err)
+	}
+	if diff := cmp.Diff(conf, &config.Config{}); diff != "" {
+		t.Errorf("missing file is not empty config (-got +want):\n%s", diff)
+	}
+}
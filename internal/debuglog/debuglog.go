@@ -0,0 +1,37 @@
+// Package debuglog is the debug logging shared by the yubage
+// packages, off unless turned on at runtime.
+//
+// Nothing logged here may contain secrets: no PINs, file keys or
+// private keys.
+package debuglog
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+var enabled int32
+
+// SetEnabled turns debug logging on or off.
+func SetEnabled(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&enabled, v)
+}
+
+// Enabled reports whether debug logging is on.
+func Enabled() bool {
+	return atomic.LoadInt32(&enabled) != 0
+}
+
+// Printf logs with the standard logger, if debug logging is on. The
+// prefix names the package logging.
+func Printf(prefix string, format string, args ...interface{}) {
+	if !Enabled() {
+		return
+	}
+	_ = log.Output(3, prefix+": "+fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,128 @@
+package pivcard
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/go-piv/piv-go/piv"
+)
+
+// Attestation is a Yubikey's proof that a key was generated on the
+// card, and cannot leave it: a certificate for the key in the slot,
+// signed by the card's attestation key, whose certificate is signed
+// by Yubico.
+type Attestation struct {
+	// Certificate is the attestation certificate of the slot.
+	Certificate *x509.Certificate
+	// Intermediate is the attestation certificate of the card.
+	Intermediate *x509.Certificate
+}
+
+// AttestedKey is what a valid attestation says about a key.
+type AttestedKey struct {
+	Public crypto.PublicKey
+	Serial uint32
+	// Firmware is the Yubikey firmware version, like "5.2.7".
+	Firmware    string
+	PINPolicy   PINPolicy
+	TouchPolicy TouchPolicy
+}
+
+// Verify checks the attestation chain against Yubico's root CA, as
+// embedded in piv-go.
+func (a *Attestation) Verify() (*AttestedKey, error) {
+	att, err := piv.Verify(a.Intermediate, a.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestation: %v", err)
+	}
+	k := &AttestedKey{
+		Public:      a.Certificate.PublicKey,
+		Serial:      att.Serial,
+		Firmware:    fmt.Sprintf("%d.%d.%d", att.Version.Major, att.Version.Minor, att.Version.Patch),
+		PINPolicy:   pinPolicyFromPIV(att.PINPolicy),
+		TouchPolicy: touchPolicyFromPIV(att.TouchPolicy),
+	}
+	return k, nil
+}
+
+// MarshalPEM returns the slot certificate followed by the card
+// certificate.
+func (a *Attestation) MarshalPEM() []byte {
+	var buf []byte
+	for _, cert := range []*x509.Certificate{a.Certificate, a.Intermediate} {
+		buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return buf
+}
+
+// ParseAttestation parses the output of MarshalPEM.
+func ParseAttestation(data []byte) (*Attestation, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block: %q", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse attestation certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) != 2 {
+		return nil, fmt.Errorf("attestation needs 2 certificates, got %d", len(certs))
+	}
+	a := &Attestation{
+		Certificate:  certs[0],
+		Intermediate: certs[1],
+	}
+	return a, nil
+}
+
+func attest(card *piv.YubiKey, slot piv.Slot) (*Attestation, error) {
+	slotCert, err := card.Attest(slot)
+	if err != nil {
+		return nil, fmt.Errorf("cannot attest slot: %v", err)
+	}
+	cardCert, err := card.AttestationCertificate()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get attestation certificate: %v", err)
+	}
+	a := &Attestation{
+		Certificate:  slotCert,
+		Intermediate: cardCert,
+	}
+	return a, nil
+}
+
+func (o *pivOpener) Attest(serial uint32, slot uint8) (*Attestation, error) {
+	pivSlot, ok := piv.RetiredKeyManagementSlot(uint32(slot))
+	if !ok {
+		return nil, fmt.Errorf("unrecognized slot: %02x", slot)
+	}
+	card, err := o.openSerial(serial)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := card.Close(); err != nil {
+			debugf("error closing PIV card: %v", err)
+		}
+	}()
+	a, err := attest(card, pivSlot)
+	if err != nil {
+		return nil, fmt.Errorf("%s slot %02x: %v", o.opts.describe(serial), slot, err)
+	}
+	return a, nil
+}
+
+// errEmulatorAttest is returned by emulated cards, which have no
+// Yubico key to vouch for them.
+var errEmulatorAttest = errors.New("emulated cards cannot attest keys")
@@ -0,0 +1,143 @@
+package pivcard
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-piv/piv-go/piv"
+)
+
+const (
+	// openRetries is how many times opening a card in use by
+	// someone else is retried, waiting openRetryDelay, doubling
+	// each time, in between.
+	openRetries    = 5
+	openRetryDelay = 100 * time.Millisecond
+)
+
+// isSharingViolation tells whether err is PC/SC saying someone else
+// has the card open. piv-go does not export the error codes, so this
+// goes by the message, or the code for unknown ones.
+func isSharingViolation(err error) bool {
+	msg := err.Error()
+	// SCARD_E_SHARING_VIOLATION
+	return strings.Contains(msg, "other connections outstanding") ||
+		strings.Contains(strings.ToLower(msg), "0x8010000b")
+}
+
+// knownHolder is a program that is known to keep cards open.
+type knownHolder struct {
+	name string
+	// match tells whether the command line is of this program
+	match func(argv []string) bool
+	// release is a signal that makes the program let go of the
+	// card, or nil if there is none
+	release os.Signal
+}
+
+func commandIs(name string) func(argv []string) bool {
+	return func(argv []string) bool {
+		return len(argv) > 0 && baseName(argv[0]) == name
+	}
+}
+
+func baseName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+var knownHolders = []*knownHolder{
+	{
+		name:    "yubikey-agent",
+		match:   commandIs("yubikey-agent"),
+		release: syscall.SIGHUP,
+	},
+	{
+		name: "age-plugin-yubikey agent",
+		match: func(argv []string) bool {
+			return len(argv) > 1 && baseName(argv[0]) == "age-plugin-yubikey" && argv[1] == "agent"
+		},
+		release: syscall.SIGHUP,
+	},
+	{
+		name:  "scdaemon",
+		match: commandIs("scdaemon"),
+	},
+}
+
+// holder is a running process that may have the card open.
+type holder struct {
+	pid  int
+	kind *knownHolder
+}
+
+func (h *holder) String() string {
+	return fmt.Sprintf("%s (pid %d)", h.kind.name, h.pid)
+}
+
+// releaseCards asks the holders that can be asked to let go of their
+// cards.
+func releaseCards(holders []*holder) {
+	for _, h := range holders {
+		if h.kind.release == nil {
+			continue
+		}
+		p, err := os.FindProcess(h.pid)
+		if err != nil {
+			continue
+		}
+		debugf("asking %v to release the card", h)
+		if err := p.Signal(h.kind.release); err != nil {
+			debugf("cannot signal %v: %v", h, err)
+		}
+	}
+}
+
+// BusyError reports a card that some other program has open.
+type BusyError struct {
+	Reader string
+	// Holders are the running programs known to keep cards open.
+	// Any of them, or something else, may be the culprit.
+	Holders []string
+}
+
+func (e *BusyError) Error() string {
+	msg := fmt.Sprintf("card in %q is in use by another program", e.Reader)
+	if len(e.Holders) > 0 {
+		msg += ", probably " + strings.Join(e.Holders, " or ")
+	}
+	return msg
+}
+
+// openReader opens the card in the named reader, waiting for a while
+// if someone else has it open. With ReleaseAgents, known agents
+// holding cards are asked to let go of them.
+func (o *pivOpener) openReader(name string) (*piv.YubiKey, error) {
+	delay := openRetryDelay
+	released := false
+	for attempt := 0; ; attempt++ {
+		card, err := piv.Open(name)
+		if err == nil {
+			return card, nil
+		}
+		if !isSharingViolation(err) {
+			return nil, fmt.Errorf("cannot open PIV card: %v", err)
+		}
+		if attempt == openRetries {
+			busy := &BusyError{Reader: name}
+			for _, h := range findHolders() {
+				busy.Holders = append(busy.Holders, h.String())
+			}
+			return nil, busy
+		}
+		if o.opts.ReleaseAgents && !released {
+			releaseCards(findHolders())
+			released = true
+		}
+		debugf("card in %q is busy, retrying in %v", name, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
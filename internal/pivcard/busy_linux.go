@@ -0,0 +1,43 @@
+package pivcard
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// findHolders looks for known card holders among the running
+// processes.
+func findHolders() []*holder {
+	dirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil
+	}
+	self := os.Getpid()
+	var holders []*holder
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(strings.TrimPrefix(dir, "/proc/"))
+		if err != nil || pid == self {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+		if err != nil {
+			// gone, or not ours to look at
+			continue
+		}
+		var argv []string
+		for _, arg := range bytes.Split(bytes.TrimSuffix(buf, []byte{0}), []byte{0}) {
+			argv = append(argv, string(arg))
+		}
+		for _, kind := range knownHolders {
+			if kind.match(argv) {
+				holders = append(holders, &holder{pid: pid, kind: kind})
+				break
+			}
+		}
+	}
+	return holders
+}
@@ -0,0 +1,476 @@
+package pivcard
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-piv/piv-go/piv"
+	"golang.org/x/crypto/curve25519"
+)
+
+// EmulatorSerial is the serial number of the card an emulator starts
+// out with, when its state file does not exist yet.
+const EmulatorSerial = 1
+
+const (
+	emulatorDefaultPIN = "123456"
+	emulatorDefaultPUK = "12345678"
+	emulatorMaxRetries = 3
+	// emulatorTouchCache is how long a touch counts with the
+	// cached touch policy, like on real Yubikeys.
+	emulatorTouchCache = 15 * time.Second
+)
+
+// emulatorState is the content of the emulator state file.
+type emulatorState struct {
+	Cards []*emulatedCard `json:"cards"`
+}
+
+type emulatedCard struct {
+	Serial  uint32 `json:"serial"`
+	PIN     string `json:"pin"`
+	Retries int    `json:"retries"`
+	// PUK is the default if empty, for state files from before
+	// it was stored.
+	PUK        string `json:"puk,omitempty"`
+	PUKRetries *int   `json:"pukRetries,omitempty"`
+	// ManagementKey is needed for generating keys.
+	ManagementKey []byte         `json:"managementKey"`
+	Keys          []*emulatedKey `json:"keys,omitempty"`
+}
+
+type emulatedKey struct {
+	Slot        uint8       `json:"slot"`
+	Name        string      `json:"name"`
+	PINPolicy   PINPolicy   `json:"pinPolicy"`
+	TouchPolicy TouchPolicy `json:"touchPolicy"`
+	// Algorithm is P-256 if zero, for state files from before it
+	// was stored.
+	Algorithm Algorithm `json:"algorithm,omitempty"`
+	// Private is the private scalar, big-endian.
+	Private []byte `json:"private"`
+}
+
+func (c *emulatedCard) key(slot uint8) *emulatedKey {
+	for _, k := range c.Keys {
+		if k.Slot == slot {
+			return k
+		}
+	}
+	return nil
+}
+
+func (k *emulatedKey) public() crypto.PublicKey {
+	curve := k.Algorithm.curve()
+	if curve == nil {
+		pub, err := curve25519.X25519(k.Private, curve25519.Basepoint)
+		if err != nil {
+			// the scalar came from crypto/rand, this can't happen
+			panic("X25519 base point multiplication failed: " + err.Error())
+		}
+		return X25519PublicKey(pub)
+	}
+	x, y := curve.ScalarBaseMult(k.Private)
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+}
+
+// sharedKey does ECDH or X25519 with the peer.
+func (k *emulatedKey) sharedKey(peer crypto.PublicKey) ([]byte, error) {
+	switch peer := peer.(type) {
+	case *ecdsa.PublicKey:
+		x, _ := peer.Curve.ScalarMult(peer.X, peer.Y, k.Private)
+		return x.FillBytes(make([]byte, (peer.Curve.Params().BitSize+7)/8)), nil
+	case X25519PublicKey:
+		shared, err := curve25519.X25519(k.Private, peer)
+		if err != nil {
+			return nil, fmt.Errorf("X25519 error: %v", err)
+		}
+		return shared, nil
+	}
+	return nil, fmt.Errorf("unsupported peer key type: %T", peer)
+}
+
+// sign makes an ASN.1 ECDSA signature of digest.
+func (k *emulatedKey) sign(digest []byte) ([]byte, error) {
+	priv := &ecdsa.PrivateKey{
+		PublicKey: *k.public().(*ecdsa.PublicKey),
+		D:         new(big.Int).SetBytes(k.Private),
+	}
+	return ecdsa.SignASN1(rand.Reader, priv, digest)
+}
+
+// emulator is a software PIV card, for development and testing on
+// machines with no Yubikey. Keys, PINs and retry counters are kept
+// in a JSON file, in plain text. Never use it for real secrets.
+type emulator struct {
+	path string
+	opts Options
+}
+
+// NewEmulator returns an Opener for software cards kept in the
+// state file at path. If the file does not exist, there is one card
+// with serial EmulatorSerial and the default PIN 123456. opts may be
+// nil; there are no readers to choose from, so only the names are
+// used.
+func NewEmulator(path string, opts *Options) Opener {
+	e := &emulator{path: path}
+	if opts != nil {
+		e.opts = *opts
+	}
+	return e
+}
+
+var _ Opener = (*emulator)(nil)
+
+func (e *emulator) load() (*emulatorState, error) {
+	buf, err := ioutil.ReadFile(e.path)
+	if os.IsNotExist(err) {
+		mgmtKey := piv.DefaultManagementKey
+		state := &emulatorState{
+			Cards: []*emulatedCard{
+				{
+					Serial:        EmulatorSerial,
+					PIN:           emulatorDefaultPIN,
+					Retries:       emulatorMaxRetries,
+					ManagementKey: mgmtKey[:],
+				},
+			},
+		}
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read emulator state: %v", err)
+	}
+	var state emulatorState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, fmt.Errorf("cannot parse emulator state: %v", err)
+	}
+	return &state, nil
+}
+
+func (e *emulator) save(state *emulatorState) error {
+	buf, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return fmt.Errorf("cannot marshal emulator state: %v", err)
+	}
+	buf = append(buf, '\n')
+	// write and rename, so concurrent readers never see a partial
+	// file
+	tmp, err := ioutil.TempFile(filepath.Dir(e.path), ".emulator-*.tmp")
+	if err != nil {
+		return fmt.Errorf("cannot save emulator state: %v", err)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(buf); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("cannot save emulator state: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("cannot save emulator state: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), e.path); err != nil {
+		return fmt.Errorf("cannot save emulator state: %v", err)
+	}
+	return nil
+}
+
+func (e *emulator) findCard(state *emulatorState, serial uint32) (*emulatedCard, error) {
+	for _, c := range state.Cards {
+		if c.Serial == serial {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("Yubikey %d not connected", serial)
+}
+
+// verifyPIN checks the PIN with the card serial, counting failed
+// attempts in the state file.
+func (e *emulator) verifyPIN(serial uint32, prompt Prompter) error {
+	state, err := e.load()
+	if err != nil {
+		return err
+	}
+	card, err := e.findCard(state, serial)
+	if err != nil {
+		return err
+	}
+	if card.Retries <= 0 {
+		return &PINError{Serial: serial, Retries: 0}
+	}
+	pin, err := prompt(pinPrompt(e.opts.describe(serial), card.Retries))
+	if err != nil {
+		return err
+	}
+	ok := subtle.ConstantTimeCompare([]byte(pin), []byte(card.PIN)) == 1
+	if ok {
+		card.Retries = emulatorMaxRetries
+	} else {
+		card.Retries--
+	}
+	if err := e.save(state); err != nil {
+		return err
+	}
+	if !ok {
+		return &PINError{Serial: serial, Retries: card.Retries}
+	}
+	return nil
+}
+
+func (e *emulator) Attest(serial uint32, slot uint8) (*Attestation, error) {
+	return nil, errEmulatorAttest
+}
+
+func (e *emulator) Unblock(serial uint32, puk string, newPIN string) error {
+	if err := checkNewPIN(newPIN); err != nil {
+		return err
+	}
+	state, err := e.load()
+	if err != nil {
+		return err
+	}
+	card, err := e.findCard(state, serial)
+	if err != nil {
+		return err
+	}
+	wantPUK := card.PUK
+	if wantPUK == "" {
+		wantPUK = emulatorDefaultPUK
+	}
+	pukRetries := emulatorMaxRetries
+	if card.PUKRetries != nil {
+		pukRetries = *card.PUKRetries
+	}
+	if pukRetries <= 0 {
+		return &PUKError{Serial: serial, Retries: 0}
+	}
+	ok := subtle.ConstantTimeCompare([]byte(puk), []byte(wantPUK)) == 1
+	if ok {
+		pukRetries = emulatorMaxRetries
+		card.PIN = newPIN
+		card.Retries = emulatorMaxRetries
+	} else {
+		pukRetries--
+	}
+	card.PUKRetries = &pukRetries
+	if err := e.save(state); err != nil {
+		return err
+	}
+	if !ok {
+		return &PUKError{Serial: serial, Retries: pukRetries}
+	}
+	return nil
+}
+
+func (e *emulator) Open(serial uint32, slot uint8) (Card, error) {
+	if slot < firstRetiredSlot || slot > lastRetiredSlot {
+		return nil, fmt.Errorf("unrecognized slot: %02x", slot)
+	}
+	state, err := e.load()
+	if err != nil {
+		return nil, err
+	}
+	card, err := e.findCard(state, serial)
+	if err != nil {
+		return nil, err
+	}
+	key := card.key(slot)
+	if key == nil {
+		return nil, fmt.Errorf("Yubikey %d has no key in slot %02x", serial, slot)
+	}
+	c := &emulatedHandle{
+		emulator:  e,
+		serial:    serial,
+		key:       key,
+		pinPolicy: key.PINPolicy,
+		touch:     key.TouchPolicy,
+	}
+	return c, nil
+}
+
+func (e *emulator) Generate(serial uint32, slot uint8, opts *KeyOptions, prompt Prompter) (crypto.PublicKey, error) {
+	if slot < firstRetiredSlot || slot > lastRetiredSlot {
+		return nil, fmt.Errorf("unrecognized slot: %02x", slot)
+	}
+	mgmtKey := piv.DefaultManagementKey
+	if opts.ManagementKey != nil {
+		mgmtKey = *opts.ManagementKey
+	}
+
+	state, err := e.load()
+	if err != nil {
+		return nil, err
+	}
+	card, err := e.findCard(state, serial)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(mgmtKey[:], card.ManagementKey) != 1 {
+		return nil, errors.New("cannot generate key: wrong management key")
+	}
+	if !opts.Overwrite && card.key(slot) != nil {
+		return nil, fmt.Errorf("slot %02x is already in use", slot)
+	}
+
+	var private []byte
+	if curve := opts.Algorithm.curve(); curve != nil {
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate key: %v", err)
+		}
+		private = priv.D.FillBytes(make([]byte, (curve.Params().BitSize+7)/8))
+	} else {
+		private = make([]byte, curve25519.ScalarSize)
+		if _, err := rand.Read(private); err != nil {
+			return nil, fmt.Errorf("cannot generate key: %v", err)
+		}
+	}
+	key := &emulatedKey{
+		Slot:        slot,
+		Name:        opts.Name,
+		PINPolicy:   opts.PINPolicy,
+		TouchPolicy: opts.TouchPolicy,
+		Algorithm:   opts.Algorithm,
+		Private:     private,
+	}
+	keys := card.Keys[:0]
+	for _, k := range card.Keys {
+		if k.Slot != slot {
+			keys = append(keys, k)
+		}
+	}
+	card.Keys = append(keys, key)
+	if err := e.save(state); err != nil {
+		return nil, err
+	}
+
+	// Signing the certificate needs the PIN on real hardware.
+	if opts.PINPolicy != PINPolicyNever {
+		if err := e.verifyPIN(serial, prompt); err != nil {
+			return nil, err
+		}
+	}
+	return key.public(), nil
+}
+
+func (e *emulator) List() ([]*CardInfo, error) {
+	state, err := e.load()
+	if err != nil {
+		return nil, err
+	}
+	var infos []*CardInfo
+	for _, card := range state.Cards {
+		info := &CardInfo{
+			Reader: fmt.Sprintf("yubage emulator %d", card.Serial),
+			Serial: card.Serial,
+		}
+		for _, k := range card.Keys {
+			info.Keys = append(info.Keys, &KeyInfo{
+				Slot:   k.Slot,
+				Name:   k.Name,
+				Public: k.public(),
+			})
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// emulatedHandle is an open emulated card. Like on hardware, the PIN
+// policy "once" and cached touches only last until it is closed.
+type emulatedHandle struct {
+	emulator    *emulator
+	serial      uint32
+	key         *emulatedKey
+	pinPolicy   PINPolicy
+	touch       TouchPolicy
+	pinVerified bool
+	lastTouch   time.Time
+}
+
+var _ Card = (*emulatedHandle)(nil)
+
+func (c *emulatedHandle) Close() error {
+	return nil
+}
+
+func (c *emulatedHandle) Public() crypto.PublicKey {
+	return c.key.public()
+}
+
+func (c *emulatedHandle) Retries() (int, error) {
+	state, err := c.emulator.load()
+	if err != nil {
+		return 0, err
+	}
+	card, err := c.emulator.findCard(state, c.serial)
+	if err != nil {
+		return 0, err
+	}
+	return card.Retries, nil
+}
+
+func (c *emulatedHandle) SharedKey(ctx context.Context, peer crypto.PublicKey, prompt Prompter, notify Notifier) ([]byte, error) {
+	if err := checkPeer(c.key.public(), peer); err != nil {
+		return nil, fmt.Errorf("PIV ECDHE error: %v", err)
+	}
+	if err := c.authorize(ctx, "PIV ECDHE", prompt, notify); err != nil {
+		return nil, err
+	}
+	return c.key.sharedKey(peer)
+}
+
+func (c *emulatedHandle) Sign(ctx context.Context, digest []byte, prompt Prompter, notify Notifier) ([]byte, error) {
+	if c.key.Algorithm.curve() == nil {
+		return nil, errors.New("PIV signing error: cannot sign with X25519 keys")
+	}
+	if err := c.authorize(ctx, "PIV signing", prompt, notify); err != nil {
+		return nil, err
+	}
+	return c.key.sign(digest)
+}
+
+// authorize asks for the PIN and touch as the policies say. what
+// names the operation in errors.
+func (c *emulatedHandle) authorize(ctx context.Context, what string, prompt Prompter, notify Notifier) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s abandoned: %w", what, err)
+	}
+
+	needPIN := c.pinPolicy == PINPolicyAlways ||
+		(c.pinPolicy == PINPolicyOnce && !c.pinVerified)
+	if needPIN {
+		if err := c.emulator.verifyPIN(c.serial, prompt); err != nil {
+			return err
+		}
+		c.pinVerified = true
+	}
+
+	now := time.Now()
+	needTouch := c.touch == TouchPolicyAlways ||
+		(c.touch == TouchPolicyCached && now.Sub(c.lastTouch) > emulatorTouchCache)
+	if needTouch {
+		// There's nobody to touch a simulated card, the message
+		// is all that happens.
+		if err := notify("Touch your " + c.emulator.opts.describe(c.serial)); err != nil {
+			return fmt.Errorf("cannot ask for touch: %v", err)
+		}
+		c.lastTouch = now
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s abandoned: %w", what, err)
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package pivcard
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/go-piv/piv-go/piv"
+)
+
+type PINPolicy int
+
+const (
+	PINPolicyNever PINPolicy = iota + 1
+	PINPolicyOnce
+	PINPolicyAlways
+)
+
+var pinPolicies = map[string]PINPolicy{
+	"never":  PINPolicyNever,
+	"once":   PINPolicyOnce,
+	"always": PINPolicyAlways,
+}
+
+func ParsePINPolicy(s string) (PINPolicy, error) {
+	p, ok := pinPolicies[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown PIN policy: %q", s)
+	}
+	return p, nil
+}
+
+func (p PINPolicy) piv() piv.PINPolicy {
+	switch p {
+	case PINPolicyNever:
+		return piv.PINPolicyNever
+	case PINPolicyOnce:
+		return piv.PINPolicyOnce
+	case PINPolicyAlways:
+		return piv.PINPolicyAlways
+	}
+	panic(fmt.Sprintf("unknown PIN policy: %d", p))
+}
+
+// pinPolicyFromPIV returns 0 for unknown policies.
+func pinPolicyFromPIV(p piv.PINPolicy) PINPolicy {
+	for _, policy := range pinPolicies {
+		if policy.piv() == p {
+			return policy
+		}
+	}
+	return 0
+}
+
+func (p PINPolicy) String() string {
+	for name, policy := range pinPolicies {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+type TouchPolicy int
+
+const (
+	TouchPolicyNever TouchPolicy = iota + 1
+	TouchPolicyAlways
+	TouchPolicyCached
+)
+
+var touchPolicies = map[string]TouchPolicy{
+	"never":  TouchPolicyNever,
+	"always": TouchPolicyAlways,
+	"cached": TouchPolicyCached,
+}
+
+func ParseTouchPolicy(s string) (TouchPolicy, error) {
+	p, ok := touchPolicies[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown touch policy: %q", s)
+	}
+	return p, nil
+}
+
+func (p TouchPolicy) piv() piv.TouchPolicy {
+	switch p {
+	case TouchPolicyNever:
+		return piv.TouchPolicyNever
+	case TouchPolicyAlways:
+		return piv.TouchPolicyAlways
+	case TouchPolicyCached:
+		return piv.TouchPolicyCached
+	}
+	panic(fmt.Sprintf("unknown touch policy: %d", p))
+}
+
+// touchPolicyFromPIV returns 0 for unknown policies.
+func touchPolicyFromPIV(p piv.TouchPolicy) TouchPolicy {
+	for _, policy := range touchPolicies {
+		if policy.piv() == p {
+			return policy
+		}
+	}
+	return 0
+}
+
+func (p TouchPolicy) String() string {
+	for name, policy := range touchPolicies {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// Algorithm is a kind of key.
+type Algorithm int
+
+const (
+	// AlgorithmP256 is the default, also for zero.
+	AlgorithmP256 Algorithm = iota + 1
+	AlgorithmP384
+	// AlgorithmX25519 needs Yubikey firmware 5.7, and is only
+	// supported by the emulator for now.
+	AlgorithmX25519
+)
+
+var algorithms = map[string]Algorithm{
+	"p256":   AlgorithmP256,
+	"p384":   AlgorithmP384,
+	"x25519": AlgorithmX25519,
+}
+
+func ParseAlgorithm(s string) (Algorithm, error) {
+	a, ok := algorithms[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown algorithm: %q", s)
+	}
+	return a, nil
+}
+
+// curve returns nil for X25519.
+func (a Algorithm) curve() elliptic.Curve {
+	switch a {
+	case 0, AlgorithmP256:
+		return elliptic.P256()
+	case AlgorithmP384:
+		return elliptic.P384()
+	case AlgorithmX25519:
+		return nil
+	}
+	panic(fmt.Sprintf("unknown algorithm: %d", a))
+}
+
+// errX25519Hardware explains why X25519 keys don't work on real
+// cards.
+var errX25519Hardware = errors.New("X25519 keys on Yubikeys are not supported yet: piv-go has no X25519")
+
+func (a Algorithm) piv() (piv.Algorithm, error) {
+	switch a {
+	case 0, AlgorithmP256:
+		return piv.AlgorithmEC256, nil
+	case AlgorithmP384:
+		return piv.AlgorithmEC384, nil
+	case AlgorithmX25519:
+		return 0, errX25519Hardware
+	}
+	panic(fmt.Sprintf("unknown algorithm: %d", a))
+}
+
+// supportedCurve tells whether keys on the curve can be used.
+func supportedCurve(curve elliptic.Curve) bool {
+	return curve == elliptic.P256() || curve == elliptic.P384()
+}
+
+// KeyOptions control the creation of new keys.
+type KeyOptions struct {
+	// Algorithm defaults to P-256.
+	Algorithm   Algorithm
+	PINPolicy   PINPolicy
+	TouchPolicy TouchPolicy
+	// Name is stored as the Common Name of the self-signed
+	// certificate.
+	Name string
+	// ManagementKey is used to authenticate key generation. Nil
+	// means the factory default.
+	ManagementKey *[24]byte
+	// Overwrite allows replacing an existing key in the slot.
+	Overwrite bool
+}
+
+// certValidity matches the yubico-piv-tool instructions this
+// replaced. Nothing checks the validity period.
+const certValidity = 10 * 365 * 24 * time.Hour
+
+func (o *pivOpener) Generate(serial uint32, slot uint8, opts *KeyOptions, prompt Prompter) (crypto.PublicKey, error) {
+	pivSlot, ok := piv.RetiredKeyManagementSlot(uint32(slot))
+	if !ok {
+		return nil, fmt.Errorf("unrecognized slot: %02x", slot)
+	}
+	algorithm, err := opts.Algorithm.piv()
+	if err != nil {
+		return nil, err
+	}
+	mgmtKey := piv.DefaultManagementKey
+	if opts.ManagementKey != nil {
+		mgmtKey = *opts.ManagementKey
+	}
+
+	card, err := o.openSerial(serial)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := card.Close(); err != nil {
+			debugf("error closing PIV card: %v", err)
+		}
+	}()
+
+	if !opts.Overwrite {
+		if _, err := card.Certificate(pivSlot); err == nil {
+			return nil, fmt.Errorf("slot %02x is already in use", slot)
+		}
+	}
+
+	pub, err := card.GenerateKey(mgmtKey, pivSlot, piv.Key{
+		Algorithm:   algorithm,
+		PINPolicy:   opts.PINPolicy.piv(),
+		TouchPolicy: opts.TouchPolicy.piv(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate key: %v", err)
+	}
+	ecPub, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unexpected public key type: %T", pub)
+	}
+
+	priv, err := card.PrivateKey(pivSlot, pub, piv.KeyAuth{
+		PINPrompt: func() (string, error) {
+			retries, err := card.Retries()
+			if err != nil {
+				return "", fmt.Errorf("cannot get PIN retries: %v", err)
+			}
+			if retries == 0 {
+				return "", &PINError{Serial: serial, Retries: 0}
+			}
+			return prompt(pinPrompt(o.opts.describe(serial), retries))
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot get PIV private key handle: %v", err)
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("PIV private key cannot sign")
+	}
+
+	certSerial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate certificate serial: %v", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: certSerial,
+		Subject: pkix.Name{
+			CommonName:   opts.Name,
+			Organization: []string{pivOrganization},
+		},
+		NotBefore: now,
+		NotAfter:  now.Add(certValidity),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, pub, signer)
+	if err != nil {
+		return nil, fmt.Errorf("cannot self-sign certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse new certificate: %v", err)
+	}
+	if err := card.SetCertificate(mgmtKey, pivSlot, cert); err != nil {
+		return nil, fmt.Errorf("cannot store certificate: %v", err)
+	}
+	return ecPub, nil
+}
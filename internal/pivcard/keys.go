@@ -0,0 +1,42 @@
+package pivcard
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"fmt"
+)
+
+// Keys for key agreement are crypto.PublicKeys of one of these types:
+//
+//	*ecdsa.PublicKey on P-256 or P-384
+//	X25519PublicKey
+//
+// Ed25519 keys, also possible on new Yubikeys, are for signing only,
+// and are never reported.
+
+// X25519PublicKey is a Curve25519 public key, as in RFC 7748.
+type X25519PublicKey []byte
+
+// X25519KeySize is the length of X25519 public keys and shared
+// secrets.
+const X25519KeySize = 32
+
+// checkPeer makes sure peer is of the same kind as pub, so key
+// agreement makes sense.
+func checkPeer(pub crypto.PublicKey, peer crypto.PublicKey) error {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		p, ok := peer.(*ecdsa.PublicKey)
+		if !ok || p.Curve != pub.Curve {
+			return fmt.Errorf("wrong peer key type for %s: %T", pub.Curve.Params().Name, peer)
+		}
+		return nil
+	case X25519PublicKey:
+		p, ok := peer.(X25519PublicKey)
+		if !ok || len(p) != X25519KeySize {
+			return fmt.Errorf("wrong peer key type for X25519: %T", peer)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type: %T", pub)
+}
@@ -5,7 +5,8 @@
 package mock_pivcard
 
 import (
-	ecdsa "crypto/ecdsa"
+	context "context"
+	crypto "crypto"
 	pivcard "eagain.net/go/yubage/internal/pivcard"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
@@ -34,6 +35,51 @@ func (m *MockOpener) EXPECT() *MockOpenerMockRecorder {
 	return m.recorder
 }
 
+// Attest mocks base method
+func (m *MockOpener) Attest(arg0 uint32, arg1 byte) (*pivcard.Attestation, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Attest", arg0, arg1)
+	ret0, _ := ret[0].(*pivcard.Attestation)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Attest indicates an expected call of Attest
+func (mr *MockOpenerMockRecorder) Attest(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Attest", reflect.TypeOf((*MockOpener)(nil).Attest), arg0, arg1)
+}
+
+// Generate mocks base method
+func (m *MockOpener) Generate(arg0 uint32, arg1 byte, arg2 *pivcard.KeyOptions, arg3 pivcard.Prompter) (crypto.PublicKey, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Generate", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(crypto.PublicKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Generate indicates an expected call of Generate
+func (mr *MockOpenerMockRecorder) Generate(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Generate", reflect.TypeOf((*MockOpener)(nil).Generate), arg0, arg1, arg2, arg3)
+}
+
+// List mocks base method
+func (m *MockOpener) List() ([]*pivcard.CardInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List")
+	ret0, _ := ret[0].([]*pivcard.CardInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List
+func (mr *MockOpenerMockRecorder) List() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockOpener)(nil).List))
+}
+
 // Open mocks base method
 func (m *MockOpener) Open(arg0 uint32, arg1 byte) (pivcard.Card, error) {
 	m.ctrl.T.Helper()
@@ -49,6 +95,20 @@ func (mr *MockOpenerMockRecorder) Open(arg0, arg1 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Open", reflect.TypeOf((*MockOpener)(nil).Open), arg0, arg1)
 }
 
+// Unblock mocks base method
+func (m *MockOpener) Unblock(arg0 uint32, arg1, arg2 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unblock", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Unblock indicates an expected call of Unblock
+func (mr *MockOpenerMockRecorder) Unblock(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unblock", reflect.TypeOf((*MockOpener)(nil).Unblock), arg0, arg1, arg2)
+}
+
 // MockCard is a mock of Card interface
 type MockCard struct {
 	ctrl     *gomock.Controller
@@ -87,10 +147,10 @@ func (mr *MockCardMockRecorder) Close() *gomock.Call {
 }
 
 // Public mocks base method
-func (m *MockCard) Public() *ecdsa.PublicKey {
+func (m *MockCard) Public() crypto.PublicKey {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "Public")
-	ret0, _ := ret[0].(*ecdsa.PublicKey)
+	ret0, _ := ret[0].(crypto.PublicKey)
 	return ret0
 }
 
@@ -100,17 +160,47 @@ func (mr *MockCardMockRecorder) Public() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Public", reflect.TypeOf((*MockCard)(nil).Public))
 }
 
+// Retries mocks base method
+func (m *MockCard) Retries() (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Retries")
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Retries indicates an expected call of Retries
+func (mr *MockCardMockRecorder) Retries() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Retries", reflect.TypeOf((*MockCard)(nil).Retries))
+}
+
 // SharedKey mocks base method
-func (m *MockCard) SharedKey(arg0 *ecdsa.PublicKey, arg1 pivcard.Prompter) ([]byte, error) {
+func (m *MockCard) SharedKey(arg0 context.Context, arg1 crypto.PublicKey, arg2 pivcard.Prompter, arg3 pivcard.Notifier) ([]byte, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "SharedKey", arg0, arg1)
+	ret := m.ctrl.Call(m, "SharedKey", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].([]byte)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // SharedKey indicates an expected call of SharedKey
-func (mr *MockCardMockRecorder) SharedKey(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockCardMockRecorder) SharedKey(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SharedKey", reflect.TypeOf((*MockCard)(nil).SharedKey), arg0, arg1, arg2, arg3)
+}
+
+// Sign mocks base method
+func (m *MockCard) Sign(arg0 context.Context, arg1 []byte, arg2 pivcard.Prompter, arg3 pivcard.Notifier) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Sign", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Sign indicates an expected call of Sign
+func (mr *MockCardMockRecorder) Sign(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SharedKey", reflect.TypeOf((*MockCard)(nil).SharedKey), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Sign", reflect.TypeOf((*MockCard)(nil).Sign), arg0, arg1, arg2, arg3)
 }
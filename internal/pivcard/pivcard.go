@@ -4,22 +4,20 @@
 package pivcard
 
 import (
+	"context"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"log"
+	"strings"
 
+	"eagain.net/go/yubage/internal/debuglog"
 	"github.com/go-piv/piv-go/piv"
 )
 
-const (
-	debug = false
-)
-
 func debugf(format string, args ...interface{}) {
-	if debug {
-		log.Printf(format, args...)
-	}
+	debuglog.Printf("pivcard", format, args...)
 }
 
 const (
@@ -28,20 +26,147 @@ const (
 
 type Opener interface {
 	Open(serial uint32, slot uint8) (Card, error)
+	Generate(serial uint32, slot uint8, opts *KeyOptions, prompt Prompter) (crypto.PublicKey, error)
+	List() ([]*CardInfo, error)
+	// Attest returns the attestation for the key in the slot.
+	Attest(serial uint32, slot uint8) (*Attestation, error)
+	// Unblock sets a new PIN, authenticating with the PUK. This
+	// works also when the PIN is blocked after too many wrong
+	// tries.
+	Unblock(serial uint32, puk string, newPIN string) error
+}
+
+// CardInfo describes a connected card and the age keys on it.
+type CardInfo struct {
+	Reader string
+	Serial uint32
+	Keys   []*KeyInfo
+}
+
+// KeyInfo describes a key in a slot with a certificate marked for
+// use with age.
+type KeyInfo struct {
+	Slot uint8
+	// Name is the Common Name of the certificate.
+	Name   string
+	Public crypto.PublicKey
 }
 
 type Prompter func(msg string) (string, error)
 
+// Notifier shows a message to the user, without waiting for a
+// response.
+type Notifier func(msg string) error
+
 type Card interface {
 	Close() error
-	Public() *ecdsa.PublicKey
-	SharedKey(peer *ecdsa.PublicKey, prompt Prompter) ([]byte, error)
+	// Public returns the public key, see keys.go for the types.
+	Public() crypto.PublicKey
+	// Retries returns how many wrong PINs are still allowed before
+	// the PIN is blocked.
+	Retries() (int, error)
+	// SharedKey does key agreement with the key on the card, and
+	// a peer key of the same type. Cancelling ctx abandons waiting
+	// for the PIN or touch; the card should be closed after that.
+	SharedKey(ctx context.Context, peer crypto.PublicKey, prompt Prompter, notify Notifier) ([]byte, error)
+	// Sign makes an ASN.1 ECDSA signature of a SHA-256 digest with
+	// the key on the card, asking for the PIN and touch like
+	// SharedKey. X25519 keys cannot sign.
+	Sign(ctx context.Context, digest []byte, prompt Prompter, notify Notifier) ([]byte, error)
+}
+
+// PINError reports a PIN that was not accepted.
+type PINError struct {
+	Serial uint32
+	// Retries is the number of attempts left before the PIN is
+	// blocked.
+	Retries int
+}
+
+func (e *PINError) Error() string {
+	if e.Retries == 0 {
+		return fmt.Sprintf("wrong PIN for Yubikey %d, PIN is now blocked, unblock it with the PUK", e.Serial)
+	}
+	return fmt.Sprintf("wrong PIN for Yubikey %d, %d tries left", e.Serial, e.Retries)
+}
+
+// PUKError reports a PUK that was not accepted.
+type PUKError struct {
+	Serial  uint32
+	Retries int
+}
+
+func (e *PUKError) Error() string {
+	if e.Retries == 0 {
+		return fmt.Sprintf("wrong PUK for Yubikey %d, PUK is now blocked", e.Serial)
+	}
+	return fmt.Sprintf("wrong PUK for Yubikey %d, %d tries left", e.Serial, e.Retries)
+}
+
+// pinPrompt is the question asking for the PIN of a card.
+func pinPrompt(desc string, retries int) string {
+	if retries == 1 {
+		return fmt.Sprintf("Enter PIN for %s (1 attempt left)", desc)
+	}
+	return fmt.Sprintf("Enter PIN for %s (%d attempts left)", desc, retries)
+}
+
+// PIN and PUK lengths allowed by the PIV standard.
+const (
+	minPINLength = 6
+	maxPINLength = 8
+)
+
+func checkNewPIN(pin string) error {
+	if len(pin) < minPINLength || len(pin) > maxPINLength {
+		return fmt.Errorf("PIN must be %d to %d characters", minPINLength, maxPINLength)
+	}
+	return nil
+}
+
+// Options adjust how an Opener finds cards and talks about them.
+type Options struct {
+	// Readers limits the PC/SC readers used to the ones whose name
+	// contains one of these, ignoring case. Empty means all.
+	Readers []string
+	// Names are friendly names for cards in prompts, by serial.
+	Names map[uint32]string
+	// ReleaseAgents allows asking known agents, such as
+	// yubikey-agent, to let go of a card they have open.
+	ReleaseAgents bool
+}
+
+// describe names the card with serial in messages to the user.
+func (o *Options) describe(serial uint32) string {
+	if name := o.Names[serial]; name != "" {
+		return fmt.Sprintf("Yubikey %q with serial %d", name, serial)
+	}
+	return fmt.Sprintf("Yubikey with serial %d", serial)
+}
+
+func (o *Options) useReader(name string) bool {
+	if len(o.Readers) == 0 {
+		return true
+	}
+	for _, r := range o.Readers {
+		if strings.Contains(strings.ToLower(name), strings.ToLower(r)) {
+			return true
+		}
+	}
+	return false
 }
 
-type pivOpener struct{}
+type pivOpener struct {
+	opts Options
+}
 
-func New() Opener {
-	return &pivOpener{}
+// New returns an Opener for connected PIV hardware. opts may be nil.
+func New(opts *Options) Opener {
+	o := &pivOpener{}
+	if opts != nil {
+		o.opts = *opts
+	}
+	return o
 }
 
 var _ Opener = (*pivOpener)(nil)
@@ -54,48 +179,168 @@ func (o *pivOpener) Open(serial uint32, slot uint8) (Card, error) {
 		return nil, fmt.Errorf("unrecognized slot: %02x", slot)
 	}
 
+	card, err := o.openSerial(serial)
+	if err != nil {
+		return nil, err
+	}
+
+	// preload public key to simplify error handling
+	cert, err := card.Certificate(pivSlot)
+	if err != nil {
+		_ = card.Close()
+		return nil, fmt.Errorf("Yubikey %d has no key in slot %02x: %v", serial, slot, err)
+	}
+
+	orgs := cert.Subject.Organization
+	if len(orgs) != 1 || orgs[0] != pivOrganization {
+		_ = card.Close()
+		return nil, fmt.Errorf("Yubikey %d slot %02x is not an age key: wrong certificate organization: %q", serial, slot, orgs)
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || !supportedCurve(pub.Curve) {
+		_ = card.Close()
+		return nil, fmt.Errorf("Yubikey %d slot %02x has an unsupported key type", serial, slot)
+	}
+
+	c := &pivCard{
+		card:   card,
+		serial: serial,
+		desc:   o.opts.describe(serial),
+		slot:   pivSlot,
+		pub:    pub,
+		touch:  o.touchPolicy(card, pivSlot),
+	}
+	return c, nil
+}
+
+// touchPolicy finds out the touch policy of the key in the slot, from
+// the attestation. It returns 0 if the policy is unknown.
+func (o *pivOpener) touchPolicy(card *piv.YubiKey, slot piv.Slot) TouchPolicy {
+	a, err := attest(card, slot)
+	if err != nil {
+		debugf("%v", err)
+		return 0
+	}
+	k, err := a.Verify()
+	if err != nil {
+		debugf("cannot verify attestation: %v", err)
+		return 0
+	}
+	return k.TouchPolicy
+}
+
+func (o *pivOpener) openSerial(serial uint32) (*piv.YubiKey, error) {
 	// the PCSC API is silly
 	cards, err := piv.Cards()
 	if err != nil {
 		return nil, fmt.Errorf("cannot list PIV cards: %v", err)
 	}
+	var busy *BusyError
 	for _, name := range cards {
+		if !o.opts.useReader(name) {
+			debugf("skipping reader %q", name)
+			continue
+		}
 		card, err := o.tryOpen(name, serial)
 		if err != nil {
 			debugf("ignoring card %q: %v", name, err)
-			_ = err
+			// a busy card may well be the one we want
+			var b *BusyError
+			if errors.As(err, &b) {
+				busy = b
+			}
 			continue
 		}
+		return card, nil
+	}
+	if busy != nil {
+		return nil, fmt.Errorf("Yubikey %d not available: %w", serial, busy)
+	}
+	return nil, fmt.Errorf("Yubikey %d not connected", serial)
+}
 
-		// preload public key to simplify error handling
-		cert, err := card.Certificate(pivSlot)
+const (
+	firstRetiredSlot = 0x82
+	lastRetiredSlot  = 0x95
+)
+
+func (o *pivOpener) List() ([]*CardInfo, error) {
+	cards, err := piv.Cards()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list PIV cards: %v", err)
+	}
+	var infos []*CardInfo
+	for _, name := range cards {
+		if !o.opts.useReader(name) {
+			debugf("skipping reader %q", name)
+			continue
+		}
+		info, err := o.listCard(name)
 		if err != nil {
-			debugf("ignoring card without certificate: %v", err)
-			_ = err
+			var busy *BusyError
+			if errors.As(err, &busy) {
+				// don't leave out cards without saying so
+				return nil, err
+			}
+			debugf("ignoring card %q: %v", name, err)
 			continue
 		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (o *pivOpener) listCard(name string) (*CardInfo, error) {
+	card, err := o.openReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := card.Close(); err != nil {
+			debugf("error closing PIV card: %v", err)
+		}
+	}()
 
+	serial, err := card.Serial()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get PIV card serial: %v", err)
+	}
+	info := &CardInfo{
+		Reader: name,
+		Serial: serial,
+	}
+	for slot := firstRetiredSlot; slot <= lastRetiredSlot; slot++ {
+		pivSlot, ok := piv.RetiredKeyManagementSlot(uint32(slot))
+		if !ok {
+			continue
+		}
+		cert, err := card.Certificate(pivSlot)
+		if err != nil {
+			// empty slot
+			continue
+		}
 		orgs := cert.Subject.Organization
 		if len(orgs) != 1 || orgs[0] != pivOrganization {
-			debugf("ignoreing card with wrong organization: %q", orgs)
 			continue
 		}
-
-		c := &pivCard{
-			card:   card,
-			serial: serial,
-			slot:   pivSlot,
-			pub:    cert.PublicKey.(*ecdsa.PublicKey),
+		pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok || !supportedCurve(pub.Curve) {
+			debugf("ignoring slot %02x with unsupported key type", slot)
+			continue
 		}
-		return c, nil
+		info.Keys = append(info.Keys, &KeyInfo{
+			Slot:   uint8(slot),
+			Name:   cert.Subject.CommonName,
+			Public: pub,
+		})
 	}
-	return nil, errors.New("card not found")
+	return info, nil
 }
 
 func (o *pivOpener) tryOpen(name string, wantSerial uint32) (*piv.YubiKey, error) {
-	card, err := piv.Open(name)
+	card, err := o.openReader(name)
 	if err != nil {
-		return nil, fmt.Errorf("cannot open PIV card: %v", err)
+		return nil, err
 	}
 	defer func() {
 		if card != nil {
@@ -121,33 +366,155 @@ func (o *pivOpener) tryOpen(name string, wantSerial uint32) (*piv.YubiKey, error
 type pivCard struct {
 	card   *piv.YubiKey
 	serial uint32
-	slot   piv.Slot
-	pub    *ecdsa.PublicKey
+	// desc is how the card is called in prompts
+	desc  string
+	slot  piv.Slot
+	pub   *ecdsa.PublicKey
+	touch TouchPolicy
+	// busy is closed when the last card operation started by
+	// usePrivate finishes, nil if none was started.
+	busy chan struct{}
 }
 
 var _ Card = (*pivCard)(nil)
 
+// wait waits for a card operation abandoned by usePrivate to
+// finish. The card gives up waiting for touch on its own after a
+// while.
+func (c *pivCard) wait() {
+	if c.busy != nil {
+		<-c.busy
+	}
+}
+
 func (c *pivCard) Close() error {
+	// don't close the card underneath an abandoned operation
+	c.wait()
 	return c.card.Close()
 }
 
-func (c *pivCard) Public() *ecdsa.PublicKey {
+func (c *pivCard) Public() crypto.PublicKey {
 	return c.pub
 }
 
-func (c *pivCard) SharedKey(peer *ecdsa.PublicKey, prompt Prompter) ([]byte, error) {
+func (c *pivCard) Retries() (int, error) {
+	retries, err := c.card.Retries()
+	if err != nil {
+		return 0, fmt.Errorf("cannot get PIN retries: %v", err)
+	}
+	return retries, nil
+}
+
+func (c *pivCard) SharedKey(ctx context.Context, peer crypto.PublicKey, prompt Prompter, notify Notifier) ([]byte, error) {
+	if err := checkPeer(c.pub, peer); err != nil {
+		return nil, fmt.Errorf("PIV ECDHE error: %v", err)
+	}
+	ecPeer := peer.(*ecdsa.PublicKey)
+	return c.usePrivate(ctx, "PIV ECDHE", prompt, notify, func(priv *piv.ECDSAPrivateKey) ([]byte, error) {
+		return priv.SharedKey(ecPeer)
+	})
+}
+
+func (c *pivCard) Sign(ctx context.Context, digest []byte, prompt Prompter, notify Notifier) ([]byte, error) {
+	return c.usePrivate(ctx, "PIV signing", prompt, notify, func(priv *piv.ECDSAPrivateKey) ([]byte, error) {
+		return priv.Sign(rand.Reader, digest, crypto.SHA256)
+	})
+}
+
+// usePrivate runs fn with the private key, prompting for the PIN and
+// touch as needed. what names the operation in errors.
+func (c *pivCard) usePrivate(ctx context.Context, what string, prompt Prompter, notify Notifier, fn func(priv *piv.ECDSAPrivateKey) ([]byte, error)) ([]byte, error) {
+	c.wait()
 	priv, err := c.card.PrivateKey(c.slot, c.pub, piv.KeyAuth{
 		PINPrompt: func() (string, error) {
-			return prompt(fmt.Sprintf("Enter PIN for Yubikey with serial %d", c.serial))
+			retries, err := c.Retries()
+			if err != nil {
+				return "", err
+			}
+			if retries == 0 {
+				return "", &PINError{Serial: c.serial, Retries: 0}
+			}
+			return prompt(pinPrompt(c.desc, retries))
 		},
 	})
 	if err != nil {
+		if pinErr := c.pinError(err); pinErr != nil {
+			return nil, pinErr
+		}
 		return nil, fmt.Errorf("cannot get PIV private key handle: %v", err)
 	}
 
-	shared, err := priv.(*piv.ECDSAPrivateKey).SharedKey(peer)
+	// With the cached policy, we cannot know whether a touch is
+	// needed; better to ask for one too many.
+	if c.touch != TouchPolicyNever {
+		if err := notify("Touch your " + c.desc); err != nil {
+			return nil, fmt.Errorf("cannot ask for touch: %v", err)
+		}
+	}
+
+	// The PIN is verified and touch waited for inside the card
+	// operation, which cannot be interrupted; let it run on its
+	// own.
+	type result struct {
+		out []byte
+		err error
+	}
+	done := make(chan result, 1)
+	busy := make(chan struct{})
+	c.busy = busy
+	go func() {
+		defer close(busy)
+		out, err := fn(priv.(*piv.ECDSAPrivateKey))
+		done <- result{out, err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s abandoned: %w", what, ctx.Err())
+	}
+	if r.err != nil {
+		if pinErr := c.pinError(r.err); pinErr != nil {
+			return nil, pinErr
+		}
+		return nil, fmt.Errorf("%s error: %v", what, r.err)
+	}
+	return r.out, nil
+}
+
+// pinError returns the *PINError in err, if the card rejected the
+// PIN or it is blocked.
+func (c *pivCard) pinError(err error) *PINError {
+	var pinErr *PINError
+	if errors.As(err, &pinErr) {
+		return pinErr
+	}
+	var authErr piv.AuthErr
+	if errors.As(err, &authErr) {
+		return &PINError{Serial: c.serial, Retries: authErr.Retries}
+	}
+	return nil
+}
+
+func (o *pivOpener) Unblock(serial uint32, puk string, newPIN string) error {
+	if err := checkNewPIN(newPIN); err != nil {
+		return err
+	}
+	card, err := o.openSerial(serial)
 	if err != nil {
-		return nil, fmt.Errorf("PIV ECDHE error: %v", err)
+		return err
+	}
+	defer func() {
+		if err := card.Close(); err != nil {
+			debugf("error closing PIV card: %v", err)
+		}
+	}()
+	if err := card.Unblock(puk, newPIN); err != nil {
+		var authErr piv.AuthErr
+		if errors.As(err, &authErr) {
+			return &PUKError{Serial: serial, Retries: authErr.Retries}
+		}
+		return fmt.Errorf("cannot unblock PIN: %v", err)
 	}
-	return shared, nil
+	return nil
 }
@@ -0,0 +1,35 @@
+package pivplug
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"eagain.net/go/yubage/internal/pivcard"
+)
+
+// AttestedRecipient returns the recipient for an attested key.
+func AttestedRecipient(k *pivcard.AttestedKey) (string, error) {
+	compressed, err := encodePublic(k.Public)
+	if err != nil {
+		return "", fmt.Errorf("attested key: %v", err)
+	}
+	return FormatPIVRecipient(compressed), nil
+}
+
+// VerifyAttestation checks that Yubico vouches for the attestation,
+// and that it is for the key of the recipient.
+func VerifyAttestation(r *PIVRecipient, a *pivcard.Attestation) (*pivcard.AttestedKey, error) {
+	k, err := a.Verify()
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := encodePublic(k.Public)
+	if err != nil {
+		return nil, fmt.Errorf("attested key: %v", err)
+	}
+	if !bytes.Equal(compressed, r.Compressed) {
+		return nil, errors.New("attestation is for a different key")
+	}
+	return k, nil
+}
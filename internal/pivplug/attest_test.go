@@ -0,0 +1,89 @@
+package pivplug_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivplug"
+)
+
+func TestAttestedRecipient(t *testing.T) {
+	pub := mustParsePublicKey(t, dummyPublic)
+	got, err := pivplug.AttestedRecipient(&pivcard.AttestedKey{Public: pub})
+	if err != nil {
+		t.Fatalf("AttestedRecipient: %v", err)
+	}
+	if e := dummyRecipient; got != e {
+		t.Errorf("wrong recipient: %q != %q", got, e)
+	}
+}
+
+func mustCertificate(t *testing.T, template, parent *x509.Certificate, pub *ecdsa.PublicKey, signer *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	return cert
+}
+
+// fakeAttestation returns an attestation for pub that looks like a
+// Yubikey's, but is not signed by Yubico.
+func fakeAttestation(t *testing.T, pub *ecdsa.PublicKey) *pivcard.Attestation {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Not Yubico PIV Attestation"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca := mustCertificate(t, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	slotTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "YubiKey PIV Attestation 82"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	slot := mustCertificate(t, slotTemplate, ca, pub, caKey)
+	return &pivcard.Attestation{Certificate: slot, Intermediate: ca}
+}
+
+func TestVerifyAttestationNotYubico(t *testing.T) {
+	slotKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := pivcard.ParseAttestation(fakeAttestation(t, &slotKey.PublicKey).MarshalPEM())
+	if err != nil {
+		t.Fatalf("ParseAttestation: %v", err)
+	}
+	recipient, err := pivplug.AttestedRecipient(&pivcard.AttestedKey{Public: &slotKey.PublicKey})
+	if err != nil {
+		t.Fatalf("AttestedRecipient: %v", err)
+	}
+	r, err := pivplug.ParsePIVRecipient(recipient)
+	if err != nil {
+		t.Fatalf("ParsePIVRecipient: %v", err)
+	}
+	if _, err := pivplug.VerifyAttestation(r, a); err == nil {
+		t.Fatal("attestation without Yubico signature was accepted")
+	}
+}
@@ -0,0 +1,111 @@
+package pivplug
+
+import (
+	"crypto/ecdh"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+)
+
+// WrapFileKeys encrypts every file key to every recipient, returning
+// the stanzas by recipient, then file key.
+//
+// For each file key, the stanzas of all recipients of one key type
+// share an ephemeral key. That is safe, as the recipient key goes
+// into the wrapping key derivation too, and saves most of the work
+// when there are many recipients. Key generation and agreement run
+// on all CPUs; the result does not depend on scheduling.
+func WrapFileKeys(recipients []*PIVRecipient, fileKeys [][]byte) ([][]*format.Stanza, error) {
+	types := make([]int, len(recipients))
+	peers := make([]*ecdh.PublicKey, len(recipients))
+	used := make([]bool, len(keyTypes))
+	for i, r := range recipients {
+		kt, err := keyTypeForPublic(r.Public)
+		if err != nil {
+			return nil, err
+		}
+		for j, t := range keyTypes {
+			if t == kt {
+				types[i] = j
+				used[j] = true
+			}
+		}
+		peer, err := ecdhPublic(r.Public)
+		if err != nil {
+			return nil, fmt.Errorf("bad recipient %s: %v", FormatPIVRecipient(r.Compressed), err)
+		}
+		peers[i] = peer
+	}
+
+	// ephemeral keys by file key, then key type
+	ephs := make([][]*ephemeralKey, len(fileKeys))
+	if err := parallel(len(fileKeys), func(k int) error {
+		ephs[k] = make([]*ephemeralKey, len(keyTypes))
+		for j, t := range keyTypes {
+			if !used[j] {
+				continue
+			}
+			eph, err := t.newEphemeral()
+			if err != nil {
+				return fmt.Errorf("generating ephemeral key failed: %v", err)
+			}
+			ephs[k][j] = eph
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	stanzas := make([][]*format.Stanza, len(recipients))
+	for i := range stanzas {
+		stanzas[i] = make([]*format.Stanza, len(fileKeys))
+	}
+	if err := parallel(len(recipients)*len(fileKeys), func(n int) error {
+		i, k := n/len(fileKeys), n%len(fileKeys)
+		j := types[i]
+		stanza, err := wrapWithEphemeral(keyTypes[j], ephs[k][j], recipients[i], peers[i], fileKeys[k])
+		if err != nil {
+			return err
+		}
+		stanzas[i][k] = stanza
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return stanzas, nil
+}
+
+// parallel calls fn with 0 to n-1, on as many goroutines as there
+// are CPUs. The error returned is the one with the lowest index.
+func parallel(n int, fn func(i int) error) error {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	errs := make([]error, n)
+	next := int64(-1)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
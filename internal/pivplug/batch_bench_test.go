@@ -0,0 +1,132 @@
+package pivplug
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+)
+
+// legacyWrapFileKey is how WrapFileKey worked before crypto/ecdh: a
+// fresh ephemeral key for every stanza, and big.Int arithmetic. It
+// is kept to compare against.
+func legacyWrapFileKey(r *PIVRecipient, fileKey []byte) (*format.Stanza, error) {
+	kt, err := keyTypeForPublic(r.Public)
+	if err != nil {
+		return nil, err
+	}
+	pub := r.Public.(*ecdsa.PublicKey)
+	eph, err := ecdsa.GenerateKey(kt.curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ephCompressed := elliptic.MarshalCompressed(eph.Curve, eph.PublicKey.X, eph.PublicKey.Y)
+	sharedNum, _ := kt.curve.ScalarMult(pub.X, pub.Y, eph.D.Bytes())
+	sharedSecret := sharedNum.FillBytes(make([]byte, (kt.curve.Params().BitSize+7)/8))
+	wrappedKey, err := wrapKey(kt, sharedSecret, ephCompressed, r.Compressed, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	stanza := &format.Stanza{
+		Type: kt.stanzaType,
+		Args: []string{r.Tag, base64.RawStdEncoding.EncodeToString(ephCompressed)},
+		Body: wrappedKey,
+	}
+	return stanza, nil
+}
+
+// teamSize is the number of recipients in the benchmarks, each
+// operation encrypts one file key to all of them.
+const teamSize = 30
+
+func benchmarkRecipients(b *testing.B) []*PIVRecipient {
+	b.Helper()
+	var recipients []*PIVRecipient
+	for i := 0; i < teamSize; i++ {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			b.Fatal(err)
+		}
+		compressed := elliptic.MarshalCompressed(key.Curve, key.PublicKey.X, key.PublicKey.Y)
+		r, err := ParsePIVRecipient(FormatPIVRecipient(compressed))
+		if err != nil {
+			b.Fatal(err)
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients
+}
+
+func BenchmarkWrapLegacy(b *testing.B) {
+	recipients := benchmarkRecipients(b)
+	fileKey := make([]byte, 16)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, r := range recipients {
+			if _, err := legacyWrapFileKey(r, fileKey); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkWrapFileKey(b *testing.B) {
+	recipients := benchmarkRecipients(b)
+	fileKey := make([]byte, 16)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, r := range recipients {
+			if _, err := WrapFileKey(r, fileKey); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkWrapFileKeys(b *testing.B) {
+	recipients := benchmarkRecipients(b)
+	fileKeys := [][]byte{make([]byte, 16)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := WrapFileKeys(recipients, fileKeys); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestLegacyWrapFileKey makes sure the benchmarks compare paths
+// that do the same thing.
+func TestLegacyWrapFileKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := elliptic.MarshalCompressed(key.Curve, key.PublicKey.X, key.PublicKey.Y)
+	r, err := ParsePIVRecipient(FormatPIVRecipient(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileKey := []byte("0123456789abcdef")
+	for _, wrap := range []func(*PIVRecipient, []byte) (*format.Stanza, error){legacyWrapFileKey, WrapFileKey} {
+		s, err := wrap(r, fileKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recip, err := parsePIVStanza(s.Type, s.Args, s.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eph := recip.EphPublic.(*ecdsa.PublicKey)
+		sharedNum, _ := eph.Curve.ScalarMult(eph.X, eph.Y, key.D.Bytes())
+		got, err := unwrapKey(recip.Type, sharedNum.FillBytes(make([]byte, 32)), recip.EphCompressed, compressed, recip.WrappedFileKey)
+		if err != nil {
+			t.Fatalf("unwrapKey: %v", err)
+		}
+		if string(got) != string(fileKey) {
+			t.Errorf("wrong file key: %q", got)
+		}
+	}
+}
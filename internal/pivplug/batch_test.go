@@ -0,0 +1,91 @@
+package pivplug_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivplug"
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+)
+
+func TestWrapFileKeys(t *testing.T) {
+	pivplug.EnableExperimentalKeys()
+	cards := pivcard.NewEmulator(filepath.Join(t.TempDir(), "emulator.json"), nil)
+	prompt := func(string) (string, error) { return "123456", nil }
+	notify := func(string) error { return nil }
+
+	var (
+		recipients []*pivplug.PIVRecipient
+		identities []*pivplug.PIVIdentity
+	)
+	for i, algorithm := range []pivcard.Algorithm{
+		pivcard.AlgorithmP256,
+		pivcard.AlgorithmP384,
+		pivcard.AlgorithmX25519,
+		pivcard.AlgorithmP256,
+	} {
+		opts := &pivcard.KeyOptions{
+			Algorithm:   algorithm,
+			PINPolicy:   pivcard.PINPolicyOnce,
+			TouchPolicy: pivcard.TouchPolicyNever,
+		}
+		recipient, identity, err := pivplug.Generate(cards, pivcard.EmulatorSerial, uint8(0x82+i), opts, prompt)
+		if err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+		r, err := pivplug.ParsePIVRecipient(recipient)
+		if err != nil {
+			t.Fatalf("ParsePIVRecipient: %v", err)
+		}
+		recipients = append(recipients, r)
+		id, err := pivplug.ParsePIVIdentity(identity)
+		if err != nil {
+			t.Fatalf("ParsePIVIdentity: %v", err)
+		}
+		identities = append(identities, id)
+	}
+	var fileKeys [][]byte
+	for i := 0; i < 5; i++ {
+		fileKeys = append(fileKeys, []byte(fmt.Sprintf("file key %7d", i)))
+	}
+
+	stanzas, err := pivplug.WrapFileKeys(recipients, fileKeys)
+	if err != nil {
+		t.Fatalf("WrapFileKeys: %v", err)
+	}
+	if len(stanzas) != len(recipients) {
+		t.Fatalf("wrong number of recipients: %d", len(stanzas))
+	}
+	for i, r := range recipients {
+		if len(stanzas[i]) != len(fileKeys) {
+			t.Fatalf("wrong number of stanzas for recipient %d: %d", i, len(stanzas[i]))
+		}
+		for k, s := range stanzas[i] {
+			if s.Args[0] != r.Tag {
+				t.Errorf("stanza %d/%d is for the wrong recipient: %v", i, k, s.Args)
+			}
+			fileKey, err := pivplug.UnwrapFileKey(context.Background(), cards, nil, identities[i:i+1], []*format.Stanza{s}, prompt, notify)
+			if err != nil {
+				t.Fatalf("UnwrapFileKey %d/%d: %v", i, k, err)
+			}
+			if !bytes.Equal(fileKey, fileKeys[k]) {
+				t.Errorf("stanza %d/%d has the wrong file key: %q", i, k, fileKey)
+			}
+		}
+	}
+
+	// recipients 0 and 3 are both P-256, and share the ephemeral
+	// key of each file key
+	for k := range fileKeys {
+		if g, e := stanzas[3][k].Args[1], stanzas[0][k].Args[1]; g != e {
+			t.Errorf("file key %d has two P-256 ephemeral keys: %s %s", k, g, e)
+		}
+		if k > 0 && stanzas[0][k].Args[1] == stanzas[0][0].Args[1] {
+			t.Errorf("file keys %d and 0 share an ephemeral key", k)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package pivplug
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"eagain.net/go/yubage/internal/pivcard"
+)
+
+// Bundle is a recipient with the proof that its key lives on a
+// Yubikey, for handing out instead of a bare recipient string.
+//
+// A bundle file is a PEM block of type "AGE YUBIKEY RECIPIENT",
+// with the fields as headers and the signature as content, followed
+// by the two attestation certificates. The signature is made with
+// the key of the recipient, over the SHA-256 hash of the fields and
+// the certificates, so the human name is vouched for too.
+type Bundle struct {
+	Name        string
+	Recipient   string
+	Serial      uint32
+	Slot        uint8
+	PINPolicy   pivcard.PINPolicy
+	TouchPolicy pivcard.TouchPolicy
+	Attestation *pivcard.Attestation
+	// Signature is an ASN.1 ECDSA signature, see Sign.
+	Signature []byte
+}
+
+const bundlePEMType = "AGE YUBIKEY RECIPIENT"
+
+// bundleSignContext starts the signed data, so the signature cannot
+// be taken for anything else.
+const bundleSignContext = "age-plugin-yubikey recipient bundle v1\n"
+
+// NewBundle returns an unsigned bundle for the key in the slot,
+// filled in from a verified attestation.
+func NewBundle(name string, slot uint8, a *pivcard.Attestation) (*Bundle, error) {
+	if strings.ContainsAny(name, "\r\n") {
+		return nil, errors.New("bundle name cannot have line breaks")
+	}
+	k, err := a.Verify()
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := AttestedRecipient(k)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bundle{
+		Name:        name,
+		Recipient:   recipient,
+		Serial:      k.Serial,
+		Slot:        slot,
+		PINPolicy:   k.PINPolicy,
+		TouchPolicy: k.TouchPolicy,
+		Attestation: a,
+	}
+	return b, nil
+}
+
+func (b *Bundle) headers() [][2]string {
+	return [][2]string{
+		{"Name", b.Name},
+		{"Recipient", b.Recipient},
+		{"Serial", strconv.FormatUint(uint64(b.Serial), 10)},
+		{"Slot", fmt.Sprintf("%02x", b.Slot)},
+		{"PIN-Policy", b.PINPolicy.String()},
+		{"Touch-Policy", b.TouchPolicy.String()},
+	}
+}
+
+// digest is what the signature is made over.
+func (b *Bundle) digest() []byte {
+	h := sha256.New()
+	_, _ = h.Write([]byte(bundleSignContext))
+	for _, kv := range b.headers() {
+		_, _ = fmt.Fprintf(h, "%s: %s\n", kv[0], kv[1])
+	}
+	_, _ = h.Write(b.Attestation.MarshalPEM())
+	return h.Sum(nil)
+}
+
+// Sign signs the bundle with the card holding its key.
+func (b *Bundle) Sign(ctx context.Context, card pivcard.Card, prompt pivcard.Prompter, notify pivcard.Notifier) error {
+	r, err := ParsePIVRecipient(b.Recipient)
+	if err != nil {
+		return err
+	}
+	pub, err := encodePublic(card.Public())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pub, r.Compressed) {
+		return fmt.Errorf("key in Yubikey %d slot %02x is not %s", b.Serial, b.Slot, b.Recipient)
+	}
+	sig, err := card.Sign(ctx, b.digest(), prompt, notify)
+	if err != nil {
+		return err
+	}
+	b.Signature = sig
+	return nil
+}
+
+// Marshal returns the bundle file.
+func (b *Bundle) Marshal() []byte {
+	block := &pem.Block{
+		Type:    bundlePEMType,
+		Headers: make(map[string]string),
+		Bytes:   b.Signature,
+	}
+	for _, kv := range b.headers() {
+		block.Headers[kv[0]] = kv[1]
+	}
+	return append(pem.EncodeToMemory(block), b.Attestation.MarshalPEM()...)
+}
+
+// ErrNotBundle means the data does not start with a bundle.
+var ErrNotBundle = errors.New("not a recipient bundle")
+
+// ParseBundle parses a bundle file. It does not check the signature
+// or the attestation, see Verify.
+func ParseBundle(data []byte) (*Bundle, error) {
+	block, rest := pem.Decode(data)
+	if block == nil || block.Type != bundlePEMType {
+		return nil, ErrNotBundle
+	}
+	h := block.Headers
+	b := &Bundle{
+		Name:      h["Name"],
+		Recipient: h["Recipient"],
+		Signature: block.Bytes,
+	}
+	serial, err := strconv.ParseUint(h["Serial"], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad serial number in bundle: %q", h["Serial"])
+	}
+	b.Serial = uint32(serial)
+	slot, err := strconv.ParseUint(h["Slot"], 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("bad slot in bundle: %q", h["Slot"])
+	}
+	b.Slot = uint8(slot)
+	if b.PINPolicy, err = pivcard.ParsePINPolicy(h["PIN-Policy"]); err != nil {
+		return nil, err
+	}
+	if b.TouchPolicy, err = pivcard.ParseTouchPolicy(h["Touch-Policy"]); err != nil {
+		return nil, err
+	}
+	if b.Attestation, err = pivcard.ParseAttestation(rest); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Verify checks that the bundle is signed by the key of the
+// recipient, and that the attestation is valid and matches the
+// bundle.
+func (b *Bundle) Verify() (*PIVRecipient, error) {
+	r, err := ParsePIVRecipient(b.Recipient)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := r.Public.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("bundle for %s: cannot sign with %T keys", b.Recipient, r.Public)
+	}
+	if !ecdsa.VerifyASN1(pub, b.digest(), b.Signature) {
+		return nil, fmt.Errorf("bundle for %s: bad signature", b.Recipient)
+	}
+	k, err := VerifyAttestation(r, b.Attestation)
+	if err != nil {
+		return nil, fmt.Errorf("bundle for %s: %v", b.Recipient, err)
+	}
+	if k.Serial != b.Serial || k.PINPolicy != b.PINPolicy || k.TouchPolicy != b.TouchPolicy {
+		return nil, fmt.Errorf("bundle for %s does not match its attestation", b.Recipient)
+	}
+	return r, nil
+}
+
+// CheckRecipient refuses recipients that have no bundle in
+// o.Bundles, if o.RequireAttestation is set. o may be nil.
+func (o *Options) CheckRecipient(r *PIVRecipient) error {
+	if o == nil || !o.RequireAttestation {
+		return nil
+	}
+	recipient := FormatPIVRecipient(r.Compressed)
+	for _, b := range o.Bundles {
+		if b.Recipient == recipient {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s has no attested recipient bundle", recipient)
+}
@@ -0,0 +1,110 @@
+package pivplug_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivplug"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBundle(t *testing.T) {
+	cards := pivcard.NewEmulator(filepath.Join(t.TempDir(), "emulator.json"), nil)
+	prompt := func(string) (string, error) { return "123456", nil }
+	notify := func(string) error { return nil }
+
+	opts := &pivcard.KeyOptions{
+		PINPolicy:   pivcard.PINPolicyOnce,
+		TouchPolicy: pivcard.TouchPolicyAlways,
+	}
+	recipient, _, err := pivplug.Generate(cards, pivcard.EmulatorSerial, 0x82, opts, prompt)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	card, err := cards.Open(pivcard.EmulatorSerial, 0x82)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer card.Close()
+
+	// Emulated cards cannot attest, and NewBundle insists on a
+	// valid attestation, so fill in the bundle by hand.
+	b := &pivplug.Bundle{
+		Name:        "Alice Example",
+		Recipient:   recipient,
+		Serial:      pivcard.EmulatorSerial,
+		Slot:        0x82,
+		PINPolicy:   pivcard.PINPolicyOnce,
+		TouchPolicy: pivcard.TouchPolicyAlways,
+		Attestation: fakeAttestation(t, card.Public().(*ecdsa.PublicKey)),
+	}
+	if err := b.Sign(context.Background(), card, prompt, notify); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	got, err := pivplug.ParseBundle(b.Marshal())
+	if err != nil {
+		t.Fatalf("ParseBundle: %v", err)
+	}
+	if diff := cmp.Diff(got, b); diff != "" {
+		t.Errorf("bundle changed in the roundtrip (-got +want):\n%s", diff)
+	}
+
+	// the signature is fine, but nobody vouches for the key
+	_, err = got.Verify()
+	if err == nil {
+		t.Fatal("bundle without Yubico attestation was accepted")
+	}
+	if strings.Contains(err.Error(), "bad signature") {
+		t.Errorf("good signature was rejected: %v", err)
+	}
+
+	got.Name = "Mallory"
+	if _, err := got.Verify(); err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Errorf("changed name was not noticed: %v", err)
+	}
+}
+
+func TestParseBundleNotBundle(t *testing.T) {
+	if _, err := pivplug.ParseBundle([]byte("age1yubikey1qds33lxxw9gaj82vqedjulgtedqeqxhv3tnu5f28zq3lpwpp25j4u9fu8kg\n")); err != pivplug.ErrNotBundle {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestCheckRecipient(t *testing.T) {
+	const attested = dummyRecipient
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := pivplug.FormatPIVRecipient(elliptic.MarshalCompressed(key.Curve, key.PublicKey.X, key.PublicKey.Y))
+	opts := &pivplug.Options{
+		Bundles:            []*pivplug.Bundle{{Recipient: attested}},
+		RequireAttestation: true,
+	}
+	for _, tc := range []struct {
+		opts      *pivplug.Options
+		recipient string
+		ok        bool
+	}{
+		{nil, other, true},
+		{&pivplug.Options{}, other, true},
+		{opts, attested, true},
+		{opts, other, false},
+	} {
+		r, err := pivplug.ParsePIVRecipient(tc.recipient)
+		if err != nil {
+			t.Fatalf("ParsePIVRecipient: %v", err)
+		}
+		err = tc.opts.CheckRecipient(r)
+		if g, e := err == nil, tc.ok; g != e {
+			t.Errorf("CheckRecipient(%s) with %+v: %v", tc.recipient, tc.opts, err)
+		}
+	}
+}
@@ -1,13 +1,7 @@
 package pivplug
 
-import "log"
-
-const (
-	debug = true
-)
+import "eagain.net/go/yubage/internal/debuglog"
 
 func debugf(format string, args ...interface{}) {
-	if debug {
-		log.Printf(format, args...)
-	}
+	debuglog.Printf("pivplug", format, args...)
 }
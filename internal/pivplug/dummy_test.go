@@ -0,0 +1,61 @@
+package pivplug_test
+
+import (
+	"crypto/ecdsa"
+	"testing"
+
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivcard/mock_pivcard"
+	"github.com/golang/mock/gomock"
+)
+
+// The tests use a dummy key, as if on a card with serial 0x01020304
+// in slot 82:
+//
+//	$ go run ./internal/debug/cmd/generate-dummy-key/main.go
+//	private                 54174045537741477645260415415255655016742280391432862109950881580092809591406
+//	public,compr,b64        A2EY/MZxUdkdTAZbLn0Ly0GQGuyK58olRxAj8LghVSVe
+//	recipient               age1yubikey1qds33lxxw9gaj82vqedjulgtedqeqxhv3tnu5f28zq3lpwpp25j4u9fu8kg
+//	tag                     e2SWhQ
+const (
+	dummySerial    = 0x01020304
+	dummySlot      = 0x82
+	dummyPrivateD  = "54174045537741477645260415415255655016742280391432862109950881580092809591406"
+	dummyPublic    = "A2EY/MZxUdkdTAZbLn0Ly0GQGuyK58olRxAj8LghVSVe"
+	dummyRecipient = "age1yubikey1qds33lxxw9gaj82vqedjulgtedqeqxhv3tnu5f28zq3lpwpp25j4u9fu8kg"
+	dummyTag       = "e2SWhQ"
+	// printf '\x01\x02\x03\x04\x82%s' "$(echo e2SWhQ==|base64 -d)"|bech32-encode AGE-PLUGIN-YUBIKEY-
+	dummyIdentity = "AGE-PLUGIN-YUBIKEY-1QSPSYQVZ0DJFDPGWQ2RKZ"
+)
+
+func dummyPrivate(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	return &ecdsa.PrivateKey{
+		PublicKey: *mustParsePublicKey(t, dummyPublic),
+		D:         mustBigInt(t, dummyPrivateD),
+	}
+}
+
+// mockDummyCard returns an Opener expecting the card with the dummy
+// key to be opened once, the card, and the call expecting the open.
+// What is done with the card is up to the caller.
+func mockDummyCard(mocks *gomock.Controller) (*mock_pivcard.MockOpener, *mock_pivcard.MockCard, *gomock.Call) {
+	cards := mock_pivcard.NewMockOpener(mocks)
+	theCard := mock_pivcard.NewMockCard(mocks)
+	open := cards.EXPECT().
+		Open(uint32(dummySerial), uint8(dummySlot)).
+		Return(theCard, nil)
+	return cards, theCard, open
+}
+
+// expectSharedKey expects a key agreement with card, with an ECDSA
+// peer key.
+func expectSharedKey(card *mock_pivcard.MockCard) *gomock.Call {
+	return card.EXPECT().
+		SharedKey(
+			gomock.Any(),
+			gomock.AssignableToTypeOf((*ecdsa.PublicKey)(nil)),
+			gomock.AssignableToTypeOf(pivcard.Prompter(nil)),
+			gomock.AssignableToTypeOf(pivcard.Notifier(nil)),
+		)
+}
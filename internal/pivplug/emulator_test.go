@@ -0,0 +1,497 @@
+package pivplug_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"eagain.net/go/yubage/internal/ageplugin"
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivplug"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEmulatorRoundtrip(t *testing.T) {
+	cards := pivcard.NewEmulator(filepath.Join(t.TempDir(), "emulator.json"), nil)
+	pin := "123456"
+	prompt := func(string) (string, error) { return pin, nil }
+
+	opts := &pivcard.KeyOptions{
+		PINPolicy:   pivcard.PINPolicyOnce,
+		TouchPolicy: pivcard.TouchPolicyAlways,
+		Name:        "test",
+	}
+	recipient, identity, err := pivplug.Generate(cards, pivcard.EmulatorSerial, 0x82, opts, prompt)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if _, _, err := pivplug.Generate(cards, pivcard.EmulatorSerial, 0x82, opts, prompt); err == nil {
+		t.Errorf("Generate overwrote a key")
+	}
+
+	keys, err := pivplug.ListKeys(cards)
+	if err != nil {
+		t.Fatalf("ListKeys: %v", err)
+	}
+	if len(keys) != 1 || len(keys[0].Keys) != 1 {
+		t.Fatalf("wrong keys: %v", keys)
+	}
+	if g, e := keys[0].Keys[0].Identity, identity; g != e {
+		t.Errorf("wrong identity: %q != %q", g, e)
+	}
+
+	fileKey := []byte("0123456789abcdef")
+	var messages []string
+	host := &ageplugin.Host{
+		RequestSecret: prompt,
+		DisplayMessage: func(text string) error {
+			messages = append(messages, text)
+			return nil
+		},
+	}
+	conn, errCh := pipePlugin(t, recipientFunc(nil))
+	stanzas, _, err := host.WrapConn(conn, []string{recipient}, [][]byte{fileKey})
+	if err != nil {
+		t.Fatalf("WrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Recipient: %v", err)
+	}
+
+	// wrong PINs count down the retries
+	pin = "000000"
+	for want := 2; want >= 1; want-- {
+		conn, errCh = pipePlugin(t, func(ctx context.Context, conn *ageplugin.Conn) error {
+			return pivplug.Identity(ctx, cards, nil, conn)
+		})
+		fileKeys, pluginErrs, err := host.UnwrapConn(conn, []string{identity}, stanzas)
+		if err != nil {
+			t.Fatalf("UnwrapConn: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("pivplug.Identity: %v", err)
+		}
+		if len(fileKeys) != 0 {
+			t.Fatalf("decrypted with wrong PIN")
+		}
+		if len(pluginErrs) != 1 || pluginErrs[0].Kind != "identity" {
+			t.Fatalf("wrong errors: %v", pluginErrs)
+		}
+		if g, e := pluginErrs[0].Message, (&pivcard.PINError{Serial: pivcard.EmulatorSerial, Retries: want}).Error(); g != e {
+			t.Errorf("wrong error: %q != %q", g, e)
+		}
+	}
+
+	pin = "123456"
+	messages = nil
+	conn, errCh = pipePlugin(t, func(ctx context.Context, conn *ageplugin.Conn) error {
+		return pivplug.Identity(ctx, cards, nil, conn)
+	})
+	fileKeys, pluginErrs, err := host.UnwrapConn(conn, []string{identity}, stanzas)
+	if err != nil {
+		t.Fatalf("UnwrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Identity: %v", err)
+	}
+	if len(pluginErrs) != 0 {
+		t.Fatalf("unexpected identity errors: %v", pluginErrs)
+	}
+	if len(fileKeys) != 1 || !bytes.Equal(fileKeys[0].Key, fileKey) {
+		t.Fatalf("wrong file keys: %v", fileKeys)
+	}
+	if len(messages) != 1 {
+		t.Errorf("wrong touch messages: %q", messages)
+	}
+}
+
+func TestEmulatorPINBlocked(t *testing.T) {
+	cards := pivcard.NewEmulator(filepath.Join(t.TempDir(), "emulator.json"), nil)
+	opts := &pivcard.KeyOptions{
+		PINPolicy:   pivcard.PINPolicyAlways,
+		TouchPolicy: pivcard.TouchPolicyNever,
+	}
+	_, _, err := pivplug.Generate(cards, pivcard.EmulatorSerial, 0x83, opts, func(string) (string, error) {
+		return "123456", nil
+	})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	card, err := cards.Open(pivcard.EmulatorSerial, 0x83)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer card.Close()
+
+	wrong := func(string) (string, error) { return "nope", nil }
+	notify := func(string) error {
+		t.Errorf("touch requested with touch policy never")
+		return nil
+	}
+	var pinErr *pivcard.PINError
+	for i := 0; i < 3; i++ {
+		if _, err := card.SharedKey(context.Background(), card.Public(), wrong, notify); !errors.As(err, &pinErr) {
+			t.Fatalf("expected PIN error: %v", err)
+		}
+	}
+	if pinErr.Retries != 0 {
+		t.Errorf("PIN not blocked: %d", pinErr.Retries)
+	}
+	right := func(string) (string, error) { return "123456", nil }
+	if _, err := card.SharedKey(context.Background(), card.Public(), right, notify); !errors.As(err, &pinErr) {
+		t.Fatalf("blocked PIN was accepted: %v", err)
+	}
+}
+
+func TestEmulatorReplay(t *testing.T) {
+	cards := pivcard.NewEmulator(filepath.Join(t.TempDir(), "emulator.json"), nil)
+	prompt := func(string) (string, error) { return "123456", nil }
+	opts := &pivcard.KeyOptions{
+		PINPolicy:   pivcard.PINPolicyOnce,
+		TouchPolicy: pivcard.TouchPolicyNever,
+	}
+	recipient, identity, err := pivplug.Generate(cards, pivcard.EmulatorSerial, 0x82, opts, prompt)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	host := &ageplugin.Host{
+		RequestSecret: prompt,
+	}
+	conn, errCh := pipePlugin(t, recipientFunc(nil))
+	stanzas, _, err := host.WrapConn(conn, []string{recipient}, [][]byte{[]byte("0123456789abcdef")})
+	if err != nil {
+		t.Fatalf("WrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Recipient: %v", err)
+	}
+
+	// record with the secrets, so the replay can decrypt too
+	transcript := new(bytes.Buffer)
+	conn, errCh = pipePlugin(t, func(ctx context.Context, conn *ageplugin.Conn) error {
+		conn.SetTranscript(ageplugin.NewTranscript(transcript, true))
+		return pivplug.Identity(ctx, cards, nil, conn)
+	})
+	if _, _, err := host.UnwrapConn(conn, []string{identity}, stanzas); err != nil {
+		t.Fatalf("UnwrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Identity: %v", err)
+	}
+	recorded, err := ageplugin.ReadTranscript(transcript)
+	if err != nil {
+		t.Fatalf("ReadTranscript: %v", err)
+	}
+
+	input, err := ageplugin.ReplayInput(recorded, nil)
+	if err != nil {
+		t.Fatalf("ReplayInput: %v", err)
+	}
+	out := new(bytes.Buffer)
+	replay := ageplugin.New(bytes.NewReader(input), out)
+	replayed := new(bytes.Buffer)
+	replay.SetTranscript(ageplugin.NewTranscript(replayed, true))
+	if err := pivplug.Identity(context.Background(), cards, nil, replay); err != nil {
+		t.Fatalf("replaying: %v", err)
+	}
+	again, err := ageplugin.ReadTranscript(replayed)
+	if err != nil {
+		t.Fatalf("ReadTranscript: %v", err)
+	}
+	if diff := cmp.Diff(again, recorded); diff != "" {
+		t.Errorf("replay differs (-got +want)\n%s", diff)
+	}
+}
+
+func TestEmulatorPINEveryUse(t *testing.T) {
+	tests := []struct {
+		name      string
+		pinPolicy pivcard.PINPolicy
+		opts      *pivplug.Options
+	}{
+		// a PIN is never replayed against the policy "always"
+		{"always", pivcard.PINPolicyAlways, nil},
+		{"no cache", pivcard.PINPolicyOnce, &pivplug.Options{NoPINCache: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testEmulatorPINEveryUse(t, tt.pinPolicy, tt.opts)
+		})
+	}
+}
+
+func testEmulatorPINEveryUse(t *testing.T, pinPolicy pivcard.PINPolicy, pluginOpts *pivplug.Options) {
+	cards := pivcard.NewEmulator(filepath.Join(t.TempDir(), "emulator.json"), &pivcard.Options{
+		Names: map[uint32]string{pivcard.EmulatorSerial: "test card"},
+	})
+	var questions []string
+	prompt := func(q string) (string, error) {
+		questions = append(questions, q)
+		return "123456", nil
+	}
+
+	opts := &pivcard.KeyOptions{
+		PINPolicy:   pinPolicy,
+		TouchPolicy: pivcard.TouchPolicyNever,
+	}
+	recipient, identity, err := pivplug.Generate(cards, pivcard.EmulatorSerial, 0x82, opts, prompt)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	host := &ageplugin.Host{
+		RequestSecret:  prompt,
+		DisplayMessage: func(string) error { return nil },
+	}
+	conn, errCh := pipePlugin(t, recipientFunc(nil))
+	fileKeys := [][]byte{[]byte("0123456789abcdef"), []byte("fedcba9876543210")}
+	stanzas, _, err := host.WrapConn(conn, []string{recipient}, fileKeys)
+	if err != nil {
+		t.Fatalf("WrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Recipient: %v", err)
+	}
+
+	questions = nil
+	conn, errCh = pipePlugin(t, func(ctx context.Context, conn *ageplugin.Conn) error {
+		return pivplug.Identity(ctx, cards, pluginOpts, conn)
+	})
+	got, pluginErrs, err := host.UnwrapConn(conn, []string{identity}, stanzas)
+	if err != nil {
+		t.Fatalf("UnwrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Identity: %v", err)
+	}
+	if len(pluginErrs) != 0 {
+		t.Fatalf("unexpected identity errors: %v", pluginErrs)
+	}
+	if len(got) != 2 {
+		t.Fatalf("wrong number of file keys: %d", len(got))
+	}
+	want := []string{
+		`Enter PIN for Yubikey "test card" with serial 1 (3 attempts left)`,
+		`Enter PIN for Yubikey "test card" with serial 1 (3 attempts left)`,
+	}
+	if diff := cmp.Diff(questions, want); diff != "" {
+		t.Errorf("wrong PIN prompts (-got +want):\n%s", diff)
+	}
+}
+
+func TestEmulatorPINRetry(t *testing.T) {
+	cards := pivcard.NewEmulator(filepath.Join(t.TempDir(), "emulator.json"), nil)
+	pins := []string{"123456"}
+	var questions []string
+	prompt := func(q string) (string, error) {
+		questions = append(questions, q)
+		pin := pins[0]
+		if len(pins) > 1 {
+			pins = pins[1:]
+		}
+		return pin, nil
+	}
+
+	opts := &pivcard.KeyOptions{
+		PINPolicy:   pivcard.PINPolicyOnce,
+		TouchPolicy: pivcard.TouchPolicyNever,
+	}
+	recipient, identity, err := pivplug.Generate(cards, pivcard.EmulatorSerial, 0x82, opts, prompt)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	host := &ageplugin.Host{
+		RequestSecret:  prompt,
+		DisplayMessage: func(string) error { return nil },
+	}
+	conn, errCh := pipePlugin(t, recipientFunc(nil))
+	stanzas, _, err := host.WrapConn(conn, []string{recipient}, [][]byte{[]byte("0123456789abcdef")})
+	if err != nil {
+		t.Fatalf("WrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Recipient: %v", err)
+	}
+
+	unwrap := func() ([]*ageplugin.FileKey, []*ageplugin.PluginError) {
+		t.Helper()
+		conn, errCh := pipePlugin(t, func(ctx context.Context, conn *ageplugin.Conn) error {
+			return pivplug.Identity(ctx, cards, nil, conn)
+		})
+		fileKeys, pluginErrs, err := host.UnwrapConn(conn, []string{identity}, stanzas)
+		if err != nil {
+			t.Fatalf("UnwrapConn: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("pivplug.Identity: %v", err)
+		}
+		return fileKeys, pluginErrs
+	}
+
+	// a typo is forgiven within the session
+	questions = nil
+	pins = []string{"000000", "123456"}
+	fileKeys, pluginErrs := unwrap()
+	if len(pluginErrs) != 0 || len(fileKeys) != 1 {
+		t.Fatalf("wrong result: %v %v", fileKeys, pluginErrs)
+	}
+	want := []string{
+		"Enter PIN for Yubikey with serial 1 (3 attempts left)",
+		"Enter PIN for Yubikey with serial 1 (2 attempts left)",
+	}
+	if diff := cmp.Diff(questions, want); diff != "" {
+		t.Errorf("wrong PIN prompts (-got +want):\n%s", diff)
+	}
+
+	// the same wrong PIN again is not tried, and the last attempt
+	// is left alone
+	pins = []string{"000000", "000000", "111111"}
+	fileKeys, pluginErrs = unwrap()
+	if len(fileKeys) != 0 || len(pluginErrs) != 1 {
+		t.Fatalf("wrong result: %v %v", fileKeys, pluginErrs)
+	}
+	pins = []string{"111111", "222222"}
+	fileKeys, pluginErrs = unwrap()
+	if len(fileKeys) != 0 || len(pluginErrs) != 1 {
+		t.Fatalf("wrong result: %v %v", fileKeys, pluginErrs)
+	}
+	if g, e := pluginErrs[0].Message, (&pivcard.PINError{Serial: pivcard.EmulatorSerial, Retries: 1}).Error(); g != e {
+		t.Errorf("wrong error: %q != %q", g, e)
+	}
+
+	pins = []string{"222222"}
+	_, _ = unwrap()
+	err = cards.Unblock(pivcard.EmulatorSerial, "00000000", "654321")
+	var pukErr *pivcard.PUKError
+	if !errors.As(err, &pukErr) || pukErr.Retries != 2 {
+		t.Fatalf("expected a PUK error: %v", err)
+	}
+	if err := cards.Unblock(pivcard.EmulatorSerial, "12345678", "654321"); err != nil {
+		t.Fatalf("Unblock: %v", err)
+	}
+	questions = nil
+	pins = []string{"654321"}
+	fileKeys, pluginErrs = unwrap()
+	if len(pluginErrs) != 0 || len(fileKeys) != 1 {
+		t.Fatalf("wrong result after unblock: %v %v", fileKeys, pluginErrs)
+	}
+	if g, e := questions, []string{"Enter PIN for Yubikey with serial 1 (3 attempts left)"}; !cmp.Equal(g, e) {
+		t.Errorf("wrong PIN prompts: %q", g)
+	}
+}
+
+func TestEmulatorP384(t *testing.T) {
+	cards := pivcard.NewEmulator(filepath.Join(t.TempDir(), "emulator.json"), nil)
+	prompt := func(string) (string, error) { return "123456", nil }
+
+	opts := &pivcard.KeyOptions{
+		Algorithm:   pivcard.AlgorithmP384,
+		PINPolicy:   pivcard.PINPolicyOnce,
+		TouchPolicy: pivcard.TouchPolicyNever,
+	}
+	recipient, identity, err := pivplug.Generate(cards, pivcard.EmulatorSerial, 0x83, opts, prompt)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	r, err := pivplug.ParsePIVRecipient(recipient)
+	if err != nil {
+		t.Fatalf("ParsePIVRecipient: %v", err)
+	}
+	if pub, ok := r.Public.(*ecdsa.PublicKey); !ok || pub.Curve.Params().Name != "P-384" {
+		t.Errorf("wrong public key: %T", r.Public)
+	}
+
+	host := &ageplugin.Host{
+		RequestSecret:  prompt,
+		DisplayMessage: func(string) error { return nil },
+	}
+	fileKey := []byte("0123456789abcdef")
+	conn, errCh := pipePlugin(t, recipientFunc(nil))
+	stanzas, _, err := host.WrapConn(conn, []string{recipient}, [][]byte{fileKey})
+	if err != nil {
+		t.Fatalf("WrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Recipient: %v", err)
+	}
+	if len(stanzas) != 1 || stanzas[0].Stanza.Type != "piv-p384" {
+		t.Fatalf("wrong stanzas: %v", stanzas)
+	}
+
+	conn, errCh = pipePlugin(t, func(ctx context.Context, conn *ageplugin.Conn) error {
+		return pivplug.Identity(ctx, cards, nil, conn)
+	})
+	fileKeys, pluginErrs, err := host.UnwrapConn(conn, []string{identity}, stanzas)
+	if err != nil {
+		t.Fatalf("UnwrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Identity: %v", err)
+	}
+	if len(pluginErrs) != 0 {
+		t.Fatalf("unexpected identity errors: %v", pluginErrs)
+	}
+	if len(fileKeys) != 1 || !bytes.Equal(fileKeys[0].Key, fileKey) {
+		t.Fatalf("wrong file keys: %v", fileKeys)
+	}
+}
+
+func TestEmulatorX25519(t *testing.T) {
+	pivplug.EnableExperimentalKeys()
+	cards := pivcard.NewEmulator(filepath.Join(t.TempDir(), "emulator.json"), nil)
+	prompt := func(string) (string, error) { return "123456", nil }
+
+	opts := &pivcard.KeyOptions{
+		Algorithm:   pivcard.AlgorithmX25519,
+		PINPolicy:   pivcard.PINPolicyOnce,
+		TouchPolicy: pivcard.TouchPolicyNever,
+	}
+	recipient, identity, err := pivplug.Generate(cards, pivcard.EmulatorSerial, 0x84, opts, prompt)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	r, err := pivplug.ParsePIVRecipient(recipient)
+	if err != nil {
+		t.Fatalf("ParsePIVRecipient: %v", err)
+	}
+	if _, ok := r.Public.(pivcard.X25519PublicKey); !ok {
+		t.Errorf("wrong public key: %T", r.Public)
+	}
+
+	host := &ageplugin.Host{
+		RequestSecret:  prompt,
+		DisplayMessage: func(string) error { return nil },
+	}
+	fileKey := []byte("0123456789abcdef")
+	conn, errCh := pipePlugin(t, recipientFunc(nil))
+	stanzas, _, err := host.WrapConn(conn, []string{recipient}, [][]byte{fileKey})
+	if err != nil {
+		t.Fatalf("WrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Recipient: %v", err)
+	}
+	if len(stanzas) != 1 || stanzas[0].Stanza.Type != "piv-x25519" {
+		t.Fatalf("wrong stanzas: %v", stanzas)
+	}
+
+	conn, errCh = pipePlugin(t, func(ctx context.Context, conn *ageplugin.Conn) error {
+		return pivplug.Identity(ctx, cards, nil, conn)
+	})
+	fileKeys, pluginErrs, err := host.UnwrapConn(conn, []string{identity}, stanzas)
+	if err != nil {
+		t.Fatalf("UnwrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Identity: %v", err)
+	}
+	if len(pluginErrs) != 0 {
+		t.Fatalf("unexpected identity errors: %v", pluginErrs)
+	}
+	if len(fileKeys) != 1 || !bytes.Equal(fileKeys[0].Key, fileKey) {
+		t.Fatalf("wrong file keys: %v", fileKeys)
+	}
+}
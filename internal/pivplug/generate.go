@@ -0,0 +1,26 @@
+package pivplug
+
+import (
+	"fmt"
+
+	"eagain.net/go/yubage/internal/pivcard"
+)
+
+// Generate creates a new key in the given slot of the PIV card, and
+// returns the matching recipient and identity strings.
+func Generate(pivcards pivcard.Opener, serial uint32, slot uint8, opts *pivcard.KeyOptions, prompt pivcard.Prompter) (recipient string, identity string, err error) {
+	if opts != nil && opts.Algorithm == pivcard.AlgorithmX25519 && !experimentalKeys {
+		return "", "", errX25519
+	}
+	pub, err := pivcards.Generate(serial, slot, opts, prompt)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot generate PIV key: %v", err)
+	}
+	compressed, err := encodePublic(pub)
+	if err != nil {
+		return "", "", err
+	}
+	recipient = FormatPIVRecipient(compressed)
+	identity = FormatPIVIdentity(serial, slot, recipient)
+	return recipient, identity, nil
+}
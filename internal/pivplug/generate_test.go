@@ -0,0 +1,42 @@
+package pivplug_test
+
+import (
+	"testing"
+
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivcard/mock_pivcard"
+	"eagain.net/go/yubage/internal/pivplug"
+	"github.com/golang/mock/gomock"
+)
+
+func TestGenerate(t *testing.T) {
+	mocks := gomock.NewController(t)
+	defer mocks.Finish()
+
+	pub := mustParsePublicKey(t, dummyPublic)
+
+	opts := &pivcard.KeyOptions{
+		PINPolicy:   pivcard.PINPolicyOnce,
+		TouchPolicy: pivcard.TouchPolicyAlways,
+		Name:        "test",
+	}
+	cards := mock_pivcard.NewMockOpener(mocks)
+	cards.EXPECT().
+		Generate(uint32(dummySerial), uint8(dummySlot), opts, gomock.Any()).
+		Return(pub, nil)
+
+	prompt := func(string) (string, error) {
+		t.Error("unexpected prompt")
+		return "", nil
+	}
+	recipient, identity, err := pivplug.Generate(cards, dummySerial, dummySlot, opts, prompt)
+	if err != nil {
+		t.Fatalf("pivplug.Generate: %v", err)
+	}
+	if g, e := recipient, dummyRecipient; g != e {
+		t.Errorf("wrong recipient: %q != %q", g, e)
+	}
+	if g, e := identity, dummyIdentity; g != e {
+		t.Errorf("wrong identity: %q != %q", g, e)
+	}
+}
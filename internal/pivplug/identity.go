@@ -1,17 +1,19 @@
 package pivplug
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"context"
+	"crypto"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
+	"strings"
 
 	"eagain.net/go/bech32"
 	"eagain.net/go/yubage/internal/ageplugin"
 	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
 )
 
 type PIVIdentity struct {
@@ -20,12 +22,14 @@ type PIVIdentity struct {
 	Tag    string
 }
 
+const identityHRP = "AGE-PLUGIN-YUBIKEY-"
+
 func ParsePIVIdentity(ident string) (*PIVIdentity, error) {
 	hrp, data, err := bech32.Decode(ident)
 	if err != nil {
 		return nil, err
 	}
-	if hrp != "AGE-PLUGIN-YUBIKEY-" {
+	if hrp != identityHRP {
 		return nil, errors.New("wrong recipient type")
 	}
 	if got := len(data); got != 4+1+4 {
@@ -41,170 +45,191 @@ func ParsePIVIdentity(ident string) (*PIVIdentity, error) {
 	return id, nil
 }
 
+// FormatPIVIdentity is the inverse of ParsePIVIdentity. The tag is
+// computed from the recipient string.
+func FormatPIVIdentity(serial uint32, slot uint8, recipient string) string {
+	hashed := sha256.Sum256([]byte(recipient))
+	data := make([]byte, 4+1+4)
+	binary.LittleEndian.PutUint32(data[:4], serial)
+	data[4] = slot
+	copy(data[5:9], hashed[:4])
+	s, err := bech32.Encode(strings.ToLower(identityHRP), data)
+	if err != nil {
+		// input data is fixed length, this just can't happen
+		panic("Bech32 encode of PIV identity failed: " + err.Error())
+	}
+	// age identities are conventionally uppercase
+	return strings.ToUpper(s)
+}
+
 type pivRecipientStanza struct {
-	Index          string
+	Type           *keyType
 	Tag            string
 	EphCompressed  []byte
+	EphPublic      crypto.PublicKey
 	WrappedFileKey []byte
 }
 
-func Identity(pivcards pivcard.Opener, conn *ageplugin.Conn) error {
-	debugf("identity plugin start")
-	defer debugf("identity plugin stop")
+var errNotPIVStanza = errors.New("not a PIV stanza")
 
-	var (
-		// these contain nil items for anything unrecognized, because
-		// we have to use original indexes in responses
+// parsePIVStanza parses the type, arguments and body of an age header
+// stanza.
+func parsePIVStanza(typ string, args []string, body []byte) (*pivRecipientStanza, error) {
+	kt := keyTypeForStanza(typ)
+	if kt == nil {
+		return nil, errNotPIVStanza
+	}
+	if len(args) != 2 {
+		return nil, fmt.Errorf("wrong number of %s arguments: %d", typ, len(args))
+	}
+	tag := args[0]
+	ephCompressed, err := base64.RawStdEncoding.Strict().DecodeString(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ephemeral public key: %v", err)
+	}
+	ephPub, err := kt.parse(ephCompressed)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing ephemeral public key: %v", err)
+	}
+	r := &pivRecipientStanza{
+		Type:           kt,
+		Tag:            tag,
+		EphCompressed:  ephCompressed,
+		EphPublic:      ephPub,
+		WrappedFileKey: body,
+	}
+	return r, nil
+}
 
-		identities []*PIVIdentity
-		recipients []*pivRecipientStanza
-	)
+// unwrapWithCard decrypts the file key in recip with the card
+// holding the identity.
+func unwrapWithCard(ctx context.Context, card *sessionCard, ident *PIVIdentity, recip *pivRecipientStanza, prompt pivcard.Prompter, notify pivcard.Notifier) ([]byte, error) {
+	pivPublicKey := card.card.Public()
+	pivType, err := keyTypeForPublic(pivPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Yubikey %d slot %02x: %v", ident.Serial, ident.Slot, err)
+	}
+	pivCompressed, err := encodePublic(pivPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Yubikey %d slot %02x: %v", ident.Serial, ident.Slot, err)
+	}
 
-loop:
-	for {
-		stanza, err := conn.ReadStanza()
-		if err == io.EOF {
-			return nil
-		}
-		if err != nil {
-			return fmt.Errorf("receive error: %v", err)
-		}
-		switch stanza.Type {
-		case "add-identity":
-			// increase the count, no matter what
-			identities = append(identities, nil)
-			if len(stanza.Args) != 1 {
-				continue
-			}
-			if len(stanza.Body) != 0 {
-				continue
-			}
-			id, err := ParsePIVIdentity(stanza.Args[0])
-			if err != nil {
-				debugf("error parsing PIV identity: %v", err)
-				_ = err
-				continue
-			}
-			identities[len(identities)-1] = id
-		case "recipient-stanza":
-			// increase the count, no matter what
-			recipients = append(recipients, nil)
-			if len(stanza.Args) != 4 {
-				continue
-			}
-			if stanza.Args[1] != "piv-p256" {
-				continue
-			}
-			tag := stanza.Args[2]
-			ephCompressed, err := base64.RawStdEncoding.Strict().DecodeString(stanza.Args[3])
-			if err != nil {
-				debugf("error parsing public key in recipient-stanza: %v", err)
-				_ = err
-				continue
-			}
-			recipients[len(recipients)-1] = &pivRecipientStanza{
-				Index:          stanza.Args[0],
-				Tag:            tag,
-				EphCompressed:  ephCompressed,
-				WrappedFileKey: stanza.Body,
-			}
-		case "done":
-			if len(stanza.Args) != 0 {
-				return errors.New("unexpected arguments in done stanza")
-			}
-			if len(stanza.Body) != 0 {
-				return errors.New("unexpected body in done stanza")
-			}
-			break loop
-		default:
-			// ignore it
-		}
+	// Compare tag again, to avoid unnecessarily prompting
+	// for PINs in case the identity is stale data
+	//
+	// The PIV-P256 format tag is defined in terms of the recipient string,
+	// not the public key. Need to encode the key from hardware to get the
+	// correct tag.
+	tag := PublicKeyTagFromRecipient(FormatPIVRecipient(pivCompressed))
+	if tag != ident.Tag {
+		return nil, fmt.Errorf("key in Yubikey %d slot %02x has changed", ident.Serial, ident.Slot)
+	}
+	if pivType != recip.Type {
+		return nil, &ageplugin.StanzaError{Err: fmt.Errorf("%s stanza for a %s key", recip.Type.stanzaType, pivType)}
 	}
 
-	for _, recip := range recipients {
-		if recip == nil {
+	sharedSecret, err := card.sharedKey(ctx, recip, prompt, notify)
+	if err != nil {
+		return nil, err
+	}
+
+	fileKey, err := unwrapKey(recip.Type, sharedSecret, recip.EphCompressed, pivCompressed, recip.WrappedFileKey)
+	if err != nil {
+		// the tag matched, so this is most likely corrupted data
+		return nil, &ageplugin.StanzaError{Err: fmt.Errorf("cannot decrypt file key: %v", err)}
+	}
+	return fileKey, nil
+}
+
+// UnwrapFileKey decrypts the file key from the first age header
+// stanza that one of the identities can open.
+func UnwrapFileKey(ctx context.Context, pivcards pivcard.Opener, opts *Options, identities []*PIVIdentity, stanzas []*format.Stanza, prompt pivcard.Prompter, notify pivcard.Notifier) ([]byte, error) {
+	session := newCardSession(pivcards, opts)
+	defer session.Close()
+
+	var lastErr error
+	for _, s := range stanzas {
+		recip, err := parsePIVStanza(s.Type, s.Args, s.Body)
+		if err == errNotPIVStanza {
 			continue
 		}
-		curve := elliptic.P256()
-		x, y := elliptic.UnmarshalCompressed(curve, recip.EphCompressed)
-		if x == nil {
-			return errors.New("cannot unmarshal P256 key")
-		}
-		ephPub := &ecdsa.PublicKey{
-			Curve: curve,
-			X:     x,
-			Y:     y,
+		if err != nil {
+			// another stanza may still open the file
+			lastErr = fmt.Errorf("malformed %s stanza: %v", s.Type, err)
+			continue
 		}
-
 		for _, ident := range identities {
-			if ident == nil {
-				continue
-			}
 			if recip.Tag != ident.Tag {
-				debugf("ident mismatch %#v vs %#v", recip, ident)
 				continue
 			}
-
-			card, err := pivcards.Open(ident.Serial, ident.Slot)
+			card, err := session.open(ident.Serial, ident.Slot)
 			if err != nil {
-				debugf("cannot open PIV card: %v", err)
-				_ = err
-				continue
-			}
-			defer func() {
-				if err := card.Close(); err != nil {
-					debugf("error closing card: %v", err)
-					_ = err
-				}
-			}()
-
-			pivPublicKey := card.Public()
-			pivCompressed := elliptic.MarshalCompressed(pivPublicKey.Curve, pivPublicKey.X, pivPublicKey.Y)
-
-			// Compare tag again, to avoid unnecessarily prompting
-			// for PINs in case the identity is stale data
-			//
-			// The PIV-P256 format tag is defined in terms of the recipient string,
-			// not the public key. Need to encode the key from hardware to get the
-			// correct	 tag.
-			tag := PublicKeyTagFromRecipient(FormatPIVRecipient(pivCompressed))
-			if tag != ident.Tag {
-				debugf("stale tag: %q != %q", tag, ident.Tag)
+				lastErr = err
 				continue
 			}
-
-			sharedSecret, err := card.SharedKey(ephPub, conn.Prompt)
+			fileKey, err := unwrapWithCard(ctx, card, ident, recip, prompt, notify)
 			if err != nil {
-				debugf("shared secret error: %v", err)
-				_ = err
+				lastErr = err
 				continue
 			}
+			return fileKey, nil
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, errors.New("no identity matched any of the recipients")
+}
 
-			fileKey, err := unwrapKey(sharedSecret, recip.EphCompressed, pivCompressed, recip.WrappedFileKey)
-			if err != nil {
-				debugf("aead decrypt: %v", err)
-				_ = err
-				continue
-			}
+// identityPlugin decrypts with Yubikeys, opening each card only once.
+type identityPlugin struct {
+	session *cardSession
+}
 
-			if err := conn.WriteStanza(&ageplugin.Stanza{
-				Type: "file-key",
-				Args: []string{recip.Index},
-				Body: []byte(fileKey),
-			}); err != nil {
-				return fmt.Errorf("writing file-key response failed: %v", err)
-			}
-			if err := conn.ReadOk(); err != nil {
-				return fmt.Errorf("file-key error: %v", err)
-			}
-		}
+var _ ageplugin.IdentityPlugin = (*identityPlugin)(nil)
+
+func (p *identityPlugin) ParseIdentity(identity string) (interface{}, error) {
+	id, err := ParsePIVIdentity(identity)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse Yubikey identity: %v", err)
 	}
+	return id, nil
+}
 
-	if err := conn.WriteStanza(&ageplugin.Stanza{
-		Type: "done",
-	}); err != nil {
-		return fmt.Errorf("writing wrap-file-key response failed: %v", err)
+func (p *identityPlugin) ParseStanza(typ string, args []string, body []byte) (interface{}, error) {
+	recip, err := parsePIVStanza(typ, args, body)
+	if err == errNotPIVStanza {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s stanza: %v", typ, err)
 	}
-	return nil
+	return recip, nil
+}
+
+func (p *identityPlugin) Unwrap(ctx context.Context, ui *ageplugin.UI, identity interface{}, stanza interface{}) ([]byte, error) {
+	ident := identity.(*PIVIdentity)
+	recip := stanza.(*pivRecipientStanza)
+	if recip.Tag != ident.Tag {
+		return nil, ageplugin.ErrNoMatch
+	}
+	card, err := p.session.open(ident.Serial, ident.Slot)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapWithCard(ctx, card, ident, recip, ui.Prompt, ui.Message)
+}
+
+// Identity runs the identity-v1 side of the plugin protocol. It gives
+// up when ctx is done, also while waiting for a PIN or touch. opts
+// may be nil.
+func Identity(ctx context.Context, pivcards pivcard.Opener, opts *Options, conn *ageplugin.Conn) error {
+	debugf("identity plugin start")
+	defer debugf("identity plugin stop")
 
+	// Each card is opened once, and used for all the stanzas it
+	// matches, so the PIN is asked at most once.
+	session := newCardSession(pivcards, opts)
+	defer session.Close()
+	return ageplugin.ServeIdentity(ctx, conn, &identityPlugin{session: session})
 }
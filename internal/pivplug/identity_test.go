@@ -2,11 +2,16 @@ package pivplug_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/base64"
+	"errors"
+	"io/ioutil"
 	"math/big"
+	"strings"
 	"testing"
+	"time"
 
 	"eagain.net/go/yubage/internal/ageplugin"
 	"eagain.net/go/yubage/internal/pivcard"
@@ -88,11 +93,13 @@ fjpIzYC+PO66AJGLI2bU4k3Fg1CN+ysEcgGHg3WPpKE
 		Return(private.Public())
 	theCard.EXPECT().
 		SharedKey(
+			gomock.Any(),
 			gomock.AssignableToTypeOf((*ecdsa.PublicKey)(nil)),
 			gomock.AssignableToTypeOf(pivcard.Prompter(nil)),
+			gomock.AssignableToTypeOf(pivcard.Notifier(nil)),
 		).
 		After(expectOpen).
-		DoAndReturn(func(peer *ecdsa.PublicKey, prompt pivcard.Prompter) ([]byte, error) {
+		DoAndReturn(func(ctx context.Context, peer *ecdsa.PublicKey, prompt pivcard.Prompter, notify pivcard.Notifier) ([]byte, error) {
 			mult, _ := ephPublic.ScalarMult(ephPublic.X, ephPublic.Y, private.D.Bytes())
 			secret := mult.Bytes()
 			return secret, nil
@@ -101,7 +108,7 @@ fjpIzYC+PO66AJGLI2bU4k3Fg1CN+ysEcgGHg3WPpKE
 		Close().
 		After(expectOpen)
 
-	if err := pivplug.Identity(cards, conn); err != nil {
+	if err := pivplug.Identity(context.Background(), cards, nil, conn); err != nil {
 		t.Fatalf("pivplug.Identity: %v", err)
 	}
 	if in.Len() != 0 {
@@ -118,3 +125,216 @@ fjpIzYC+PO66AJGLI2bU4k3Fg1CN+ysEcgGHg3WPpKE
 		t.Errorf("unexpected output (-got +want):\n%s", diff)
 	}
 }
+
+func TestFormatPIVIdentity(t *testing.T) {
+	s := pivplug.FormatPIVIdentity(dummySerial, dummySlot, dummyRecipient)
+	id, err := pivplug.ParsePIVIdentity(s)
+	if err != nil {
+		t.Fatalf("ParsePIVIdentity: %v", err)
+	}
+	want := &pivplug.PIVIdentity{
+		Serial: dummySerial,
+		Slot:   dummySlot,
+		Tag:    pivplug.PublicKeyTagFromRecipient(dummyRecipient),
+	}
+	if *id != *want {
+		t.Errorf("wrong identity: %+v != %+v", id, want)
+	}
+}
+
+func TestIdentityChatErrors(t *testing.T) {
+	mocks := gomock.NewController(t)
+	defer mocks.Finish()
+
+	private := dummyPrivate(t)
+
+	in := new(bytes.Buffer)
+	out := new(bytes.Buffer)
+	// identity 0 is garbage, identity 1 and 2 are the same key on
+	// two cards, the first one not connected and the second with
+	// a wrong PIN; stanza 1 is a malformed piv-p256 stanza. The host
+	// acknowledges each of the four errors.
+	in.WriteString(`
+-> add-identity AGE-PLUGIN-YUBIKEY-1GARBAGE
+
+-> add-identity AGE-PLUGIN-YUBIKEY-1QSPSYQVZ0DJFDPGWQ2RKZ
+
+-> add-identity AGE-PLUGIN-YUBIKEY-1QCPSYQVZ0DJFDPGWZEUW2
+
+-> recipient-stanza 0 piv-p256 e2SWhQ AuXWo0GaigX07s5MpZ3O7W0LepaRgaQRZ8hcFzQyGPc5
+fjpIzYC+PO66AJGLI2bU4k3Fg1CN+ysEcgGHg3WPpKE
+-> recipient-stanza 0 piv-p256 e2SWhQ
+fjpIzYC+PO66AJGLI2bU4k3Fg1CN+ysEcgGHg3WPpKE
+-> done
+
+-> ok
+
+-> ok
+
+-> ok
+
+-> ok
+
+`[1:])
+
+	conn := ageplugin.New(in, out)
+	cards := mock_pivcard.NewMockOpener(mocks)
+	theCard := mock_pivcard.NewMockCard(mocks)
+	cards.EXPECT().
+		Open(uint32(dummySerial), uint8(dummySlot)).
+		Return(nil, errors.New("Yubikey 16909060 not connected"))
+	expectOpen := cards.EXPECT().
+		Open(uint32(0x01020306), uint8(0x82)).
+		Return(theCard, nil)
+	theCard.EXPECT().
+		Public().
+		After(expectOpen).
+		Return(private.Public())
+	expectSharedKey(theCard).
+		After(expectOpen).
+		Return(nil, &pivcard.PINError{Serial: 0x01020306, Retries: 2})
+	theCard.EXPECT().
+		Close().
+		After(expectOpen)
+
+	if err := pivplug.Identity(context.Background(), cards, nil, conn); err != nil {
+		t.Fatalf("pivplug.Identity: %v", err)
+	}
+	if in.Len() != 0 {
+		t.Errorf("unconsumed input:\n%s", in.Bytes())
+	}
+
+	// check the error stanzas without caring about the exact
+	// messages, except for the PIN one
+	var got []string
+	replies := ageplugin.New(out, ioutil.Discard)
+	for len(got) == 0 || got[len(got)-1] != "done" {
+		stanza, err := replies.ReadStanza()
+		if err != nil {
+			t.Fatalf("bad output: %v", err)
+		}
+		got = append(got, strings.Join(append([]string{stanza.Type}, stanza.Args...), " "))
+		if stanza.Type == "error" && cmp.Equal(stanza.Args, []string{"identity", "2"}) {
+			if g, e := string(stanza.Body), "wrong PIN for Yubikey 16909062, 2 tries left"; g != e {
+				t.Errorf("wrong PIN error message: %q != %q", g, e)
+			}
+		}
+	}
+	want := []string{
+		"error identity 0",
+		"error stanza 1",
+		"error identity 1",
+		"error identity 2",
+		"done",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected output (-got +want):\n%s", diff)
+	}
+}
+
+func TestIdentityChatMissingCard(t *testing.T) {
+	mocks := gomock.NewController(t)
+	defer mocks.Finish()
+
+	private := dummyPrivate(t)
+
+	in := new(bytes.Buffer)
+	out := new(bytes.Buffer)
+	// the same key on two cards, the first one not connected; the
+	// second stanza is for a file key already unwrapped
+	in.WriteString(`
+-> add-identity AGE-PLUGIN-YUBIKEY-1QSPSYQVZ0DJFDPGWQ2RKZ
+
+-> add-identity AGE-PLUGIN-YUBIKEY-1QCPSYQVZ0DJFDPGWZEUW2
+
+-> recipient-stanza 0 piv-p256 e2SWhQ AuXWo0GaigX07s5MpZ3O7W0LepaRgaQRZ8hcFzQyGPc5
+fjpIzYC+PO66AJGLI2bU4k3Fg1CN+ysEcgGHg3WPpKE
+-> recipient-stanza 0 piv-p256 e2SWhQ AuXWo0GaigX07s5MpZ3O7W0LepaRgaQRZ8hcFzQyGPc5
+fjpIzYC+PO66AJGLI2bU4k3Fg1CN+ysEcgGHg3WPpKE
+-> done
+
+-> ok
+
+`[1:])
+
+	// ephemeral public key from the above recipient-stanza
+	ephPublic := mustParsePublicKey(t, "AuXWo0GaigX07s5MpZ3O7W0LepaRgaQRZ8hcFzQyGPc5")
+
+	conn := ageplugin.New(in, out)
+	cards := mock_pivcard.NewMockOpener(mocks)
+	theCard := mock_pivcard.NewMockCard(mocks)
+	cards.EXPECT().
+		Open(uint32(dummySerial), uint8(dummySlot)).
+		Return(nil, errors.New("Yubikey 16909060 not connected"))
+	expectOpen := cards.EXPECT().
+		Open(uint32(0x01020306), uint8(0x82)).
+		Return(theCard, nil)
+	theCard.EXPECT().
+		Public().
+		After(expectOpen).
+		Return(private.Public())
+	expectSharedKey(theCard).
+		After(expectOpen).
+		DoAndReturn(func(ctx context.Context, peer *ecdsa.PublicKey, prompt pivcard.Prompter, notify pivcard.Notifier) ([]byte, error) {
+			mult, _ := ephPublic.ScalarMult(ephPublic.X, ephPublic.Y, private.D.Bytes())
+			return mult.FillBytes(make([]byte, 32)), nil
+		})
+	theCard.EXPECT().
+		Close().
+		After(expectOpen)
+
+	if err := pivplug.Identity(context.Background(), cards, nil, conn); err != nil {
+		t.Fatalf("pivplug.Identity: %v", err)
+	}
+	if in.Len() != 0 {
+		t.Errorf("unconsumed input:\n%s", in.Bytes())
+	}
+	want := `
+-> file-key 0
+39MwXeehyuGJAvn2xYi48A
+-> done
+
+`[1:]
+	got := out.String()
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("unexpected output (-got +want):\n%s", diff)
+	}
+}
+
+func TestIdentityChatTimeout(t *testing.T) {
+	mocks := gomock.NewController(t)
+	defer mocks.Finish()
+
+	private := dummyPrivate(t)
+
+	in := new(bytes.Buffer)
+	out := new(bytes.Buffer)
+	in.WriteString(`
+-> add-identity AGE-PLUGIN-YUBIKEY-1QSPSYQVZ0DJFDPGWQ2RKZ
+
+-> recipient-stanza 0 piv-p256 e2SWhQ AuXWo0GaigX07s5MpZ3O7W0LepaRgaQRZ8hcFzQyGPc5
+fjpIzYC+PO66AJGLI2bU4k3Fg1CN+ysEcgGHg3WPpKE
+-> done
+
+`[1:])
+
+	conn := ageplugin.New(in, out)
+	cards, theCard, _ := mockDummyCard(mocks)
+	theCard.EXPECT().
+		Public().
+		Return(private.Public())
+	// nobody touches the card
+	expectSharedKey(theCard).
+		DoAndReturn(func(ctx context.Context, peer *ecdsa.PublicKey, prompt pivcard.Prompter, notify pivcard.Notifier) ([]byte, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+	theCard.EXPECT().
+		Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := pivplug.Identity(ctx, cards, nil, conn); err == nil {
+		t.Fatal("expected an error")
+	}
+}
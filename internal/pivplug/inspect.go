@@ -0,0 +1,62 @@
+package pivplug
+
+import (
+	"encoding/base64"
+
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+)
+
+// StanzaInfo describes an age header stanza, and which of the known
+// keys can open it.
+type StanzaInfo struct {
+	Type string
+	// Err is set for PIV stanzas that cannot be parsed.
+	Err error
+	// Tag and EphemeralKey are set for PIV stanzas.
+	Tag          string
+	EphemeralKey []byte
+	// Identities lists the given identities with a matching tag.
+	Identities []*PIVIdentity
+	// Keys lists the hardware keys with a matching tag.
+	Keys []*HardwareKey
+}
+
+// EphemeralKeyString returns the ephemeral key as it appears in the
+// stanza.
+func (s *StanzaInfo) EphemeralKeyString() string {
+	return base64.RawStdEncoding.EncodeToString(s.EphemeralKey)
+}
+
+// Inspect matches the stanzas of an age header against identities
+// and hardware keys. Only tags are compared, so no PIN is needed, and
+// a match is not a guarantee that decryption will succeed.
+func Inspect(stanzas []*format.Stanza, identities []*PIVIdentity, keys []*HardwareKey) []*StanzaInfo {
+	infos := make([]*StanzaInfo, 0, len(stanzas))
+	for _, s := range stanzas {
+		info := &StanzaInfo{
+			Type: s.Type,
+		}
+		infos = append(infos, info)
+		recip, err := parsePIVStanza(s.Type, s.Args, s.Body)
+		if err == errNotPIVStanza {
+			continue
+		}
+		if err != nil {
+			info.Err = err
+			continue
+		}
+		info.Tag = recip.Tag
+		info.EphemeralKey = recip.EphCompressed
+		for _, ident := range identities {
+			if ident.Tag == recip.Tag {
+				info.Identities = append(info.Identities, ident)
+			}
+		}
+		for _, k := range keys {
+			if PublicKeyTagFromRecipient(k.Recipient) == recip.Tag {
+				info.Keys = append(info.Keys, k)
+			}
+		}
+	}
+	return infos
+}
@@ -0,0 +1,64 @@
+package pivplug_test
+
+import (
+	"testing"
+
+	"eagain.net/go/yubage/internal/pivplug"
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+)
+
+func TestInspect(t *testing.T) {
+	identity, err := pivplug.ParsePIVIdentity(dummyIdentity)
+	if err != nil {
+		t.Fatalf("ParsePIVIdentity: %v", err)
+	}
+	key := &pivplug.HardwareKey{
+		Serial:    dummySerial,
+		Slot:      dummySlot,
+		Recipient: dummyRecipient,
+		Identity:  dummyIdentity,
+	}
+	otherKey := &pivplug.HardwareKey{
+		Serial:    42,
+		Slot:      0x83,
+		Recipient: "age1yubikey1qfake",
+	}
+	stanzas := []*format.Stanza{
+		{Type: "X25519", Args: []string{"noise"}, Body: []byte("noise")},
+		{Type: "piv-p256", Args: []string{dummyTag, "AuXWo0GaigX07s5MpZ3O7W0LepaRgaQRZ8hcFzQyGPc5"}, Body: []byte("wrapped")},
+		{Type: "piv-p256", Args: []string{"AAAAAA", "AuXWo0GaigX07s5MpZ3O7W0LepaRgaQRZ8hcFzQyGPc5"}, Body: []byte("wrapped")},
+		{Type: "piv-p256", Args: []string{dummyTag}, Body: []byte("wrapped")},
+	}
+	infos := pivplug.Inspect(stanzas, []*pivplug.PIVIdentity{identity}, []*pivplug.HardwareKey{otherKey, key})
+	if g, e := len(infos), len(stanzas); g != e {
+		t.Fatalf("wrong number of results: %d != %d", g, e)
+	}
+
+	if g, e := infos[0].Type, "X25519"; g != e {
+		t.Errorf("wrong type: %q != %q", g, e)
+	}
+	if infos[0].Tag != "" || infos[0].Err != nil {
+		t.Errorf("non-PIV stanza was inspected: %+v", infos[0])
+	}
+
+	if g, e := infos[1].Tag, dummyTag; g != e {
+		t.Errorf("wrong tag: %q != %q", g, e)
+	}
+	if g, e := infos[1].EphemeralKeyString(), "AuXWo0GaigX07s5MpZ3O7W0LepaRgaQRZ8hcFzQyGPc5"; g != e {
+		t.Errorf("wrong ephemeral key: %q != %q", g, e)
+	}
+	if len(infos[1].Identities) != 1 || infos[1].Identities[0] != identity {
+		t.Errorf("wrong identities: %v", infos[1].Identities)
+	}
+	if len(infos[1].Keys) != 1 || infos[1].Keys[0] != key {
+		t.Errorf("wrong keys: %v", infos[1].Keys)
+	}
+
+	if len(infos[2].Identities) != 0 || len(infos[2].Keys) != 0 {
+		t.Errorf("unexpected match: %+v", infos[2])
+	}
+
+	if infos[3].Err == nil {
+		t.Errorf("expected error for malformed stanza")
+	}
+}
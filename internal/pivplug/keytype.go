@@ -0,0 +1,203 @@
+package pivplug
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"eagain.net/go/yubage/internal/pivcard"
+)
+
+// keyType is what differs between the supported kinds of PIV keys.
+// Recipients of all types share the age1yubikey prefix, as that
+// picks the plugin; the length of the encoded key tells them apart.
+//
+// Elliptic curve keys are encoded as compressed points, X25519 keys
+// as the raw 32 bytes.
+//
+// X25519 only works with the emulator, as piv-go cannot use X25519
+// keys on cards, so its recipient and stanza formats are not settled.
+// It is off unless EnableExperimentalKeys is called.
+type keyType struct {
+	// curve is nil for X25519 keys.
+	curve elliptic.Curve
+	// ecdh does the key agreement in constant time.
+	ecdh ecdh.Curve
+	// stanzaType is the type of age header stanzas for the keys.
+	stanzaType string
+	// wrapLabel is the HKDF info for deriving the wrapping key.
+	wrapLabel string
+	// experimental types are ignored unless enabled.
+	experimental bool
+}
+
+var keyTypes = []*keyType{
+	{
+		curve:      elliptic.P256(),
+		ecdh:       ecdh.P256(),
+		stanzaType: "piv-p256",
+		wrapLabel:  "age-encryption.org/v1/piv-p256",
+	},
+	{
+		curve:      elliptic.P384(),
+		ecdh:       ecdh.P384(),
+		stanzaType: "piv-p384",
+		wrapLabel:  "age-encryption.org/v1/piv-p384",
+	},
+	{
+		ecdh:         ecdh.X25519(),
+		stanzaType:   "piv-x25519",
+		wrapLabel:    "age-encryption.org/v1/piv-x25519",
+		experimental: true,
+	},
+}
+
+// experimentalKeys enables the experimental key types.
+var experimentalKeys bool
+
+// EnableExperimentalKeys accepts X25519 recipients, stanzas and card
+// keys. Files encrypted to them may not decrypt with later versions.
+// It must be called before anything else in the package is used.
+func EnableExperimentalKeys() {
+	experimentalKeys = true
+}
+
+// errX25519 refuses X25519 keys when experiments are off.
+var errX25519 = errors.New("X25519 keys are experimental, and only work with the emulator")
+
+func (t *keyType) enabled() bool {
+	return !t.experimental || experimentalKeys
+}
+
+func (t *keyType) String() string {
+	if t.curve == nil {
+		return "X25519"
+	}
+	return t.curve.Params().Name
+}
+
+// encodedSize is the length of an encoded public key.
+func (t *keyType) encodedSize() int {
+	if t.curve == nil {
+		return pivcard.X25519KeySize
+	}
+	return 1 + (t.curve.Params().BitSize+7)/8
+}
+
+// parse decodes a public key encoded as by encodePublic.
+func (t *keyType) parse(encoded []byte) (crypto.PublicKey, error) {
+	if len(encoded) != t.encodedSize() {
+		return nil, fmt.Errorf("wrong %s key length: %d", t, len(encoded))
+	}
+	if t.curve == nil {
+		return pivcard.X25519PublicKey(encoded), nil
+	}
+	x, y := elliptic.UnmarshalCompressed(t.curve, encoded)
+	if x == nil {
+		return nil, fmt.Errorf("does not contain a compressed %s key", t)
+	}
+	pub := &ecdsa.PublicKey{
+		Curve: t.curve,
+		X:     x,
+		Y:     y,
+	}
+	return pub, nil
+}
+
+// ephemeralKey is the sender side of the key agreement.
+type ephemeralKey struct {
+	private *ecdh.PrivateKey
+	// encoded is the public key as used in stanzas.
+	encoded []byte
+}
+
+// newEphemeral makes a new key for agreeing on shared secrets with
+// keys of this type.
+func (t *keyType) newEphemeral() (*ephemeralKey, error) {
+	priv, err := t.ecdh.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	encoded := priv.PublicKey().Bytes()
+	if t.curve != nil {
+		encoded = compressPoint(encoded)
+	}
+	return &ephemeralKey{private: priv, encoded: encoded}, nil
+}
+
+// compressPoint turns an uncompressed NIST curve point into the
+// compressed form of SEC 1.
+func compressPoint(uncompressed []byte) []byte {
+	size := (len(uncompressed) - 1) / 2
+	compressed := make([]byte, 1+size)
+	compressed[0] = 2 | uncompressed[len(uncompressed)-1]&1
+	copy(compressed[1:], uncompressed[1:1+size])
+	return compressed
+}
+
+// ecdhPublic converts a recipient key for use with crypto/ecdh.
+func ecdhPublic(pub crypto.PublicKey) (*ecdh.PublicKey, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		return pub.ECDH()
+	case pivcard.X25519PublicKey:
+		return ecdh.X25519().NewPublicKey(pub)
+	}
+	return nil, fmt.Errorf("unsupported key type: %T", pub)
+}
+
+// encodePublic returns the key as used in recipients and stanzas.
+func encodePublic(pub crypto.PublicKey) ([]byte, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		return elliptic.MarshalCompressed(pub.Curve, pub.X, pub.Y), nil
+	case pivcard.X25519PublicKey:
+		if !experimentalKeys {
+			return nil, errX25519
+		}
+		return []byte(pub), nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %T", pub)
+}
+
+func keyTypeForPublic(pub crypto.PublicKey) (*keyType, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		for _, t := range keyTypes {
+			if t.curve == pub.Curve {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("unsupported curve: %s", pub.Curve.Params().Name)
+	case pivcard.X25519PublicKey:
+		for _, t := range keyTypes {
+			if t.enabled() && t.curve == nil {
+				return t, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unsupported key type: %T", pub)
+}
+
+func keyTypeForEncoded(encoded []byte) (*keyType, error) {
+	for _, t := range keyTypes {
+		if t.enabled() && t.encodedSize() == len(encoded) {
+			return t, nil
+		}
+	}
+	return nil, errors.New("does not contain a P-256 or P-384 key")
+}
+
+// keyTypeForStanza returns nil if typ is not a PIV stanza type.
+func keyTypeForStanza(typ string) *keyType {
+	for _, t := range keyTypes {
+		if t.enabled() && t.stanzaType == typ {
+			return t
+		}
+	}
+	return nil
+}
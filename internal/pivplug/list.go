@@ -0,0 +1,55 @@
+package pivplug
+
+import (
+	"fmt"
+
+	"eagain.net/go/yubage/internal/pivcard"
+)
+
+// CardKeys describes the age keys found on one PIV card.
+type CardKeys struct {
+	Reader string
+	Serial uint32
+	Keys   []*HardwareKey
+}
+
+// HardwareKey is an age key stored on a PIV card.
+type HardwareKey struct {
+	Serial    uint32
+	Slot      uint8
+	Name      string
+	Recipient string
+	Identity  string
+}
+
+// ListKeys returns the recipients and identities for all keys on all
+// connected PIV cards.
+func ListKeys(pivcards pivcard.Opener) ([]*CardKeys, error) {
+	infos, err := pivcards.List()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list PIV cards: %v", err)
+	}
+	cards := make([]*CardKeys, 0, len(infos))
+	for _, info := range infos {
+		card := &CardKeys{
+			Reader: info.Reader,
+			Serial: info.Serial,
+		}
+		for _, k := range info.Keys {
+			compressed, err := encodePublic(k.Public)
+			if err != nil {
+				return nil, fmt.Errorf("Yubikey %d slot %02x: %v", info.Serial, k.Slot, err)
+			}
+			recipient := FormatPIVRecipient(compressed)
+			card.Keys = append(card.Keys, &HardwareKey{
+				Serial:    info.Serial,
+				Slot:      k.Slot,
+				Name:      k.Name,
+				Recipient: recipient,
+				Identity:  FormatPIVIdentity(info.Serial, k.Slot, recipient),
+			})
+		}
+		cards = append(cards, card)
+	}
+	return cards, nil
+}
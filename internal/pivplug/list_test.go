@@ -0,0 +1,62 @@
+package pivplug_test
+
+import (
+	"testing"
+
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivcard/mock_pivcard"
+	"eagain.net/go/yubage/internal/pivplug"
+	"github.com/golang/mock/gomock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestListKeys(t *testing.T) {
+	mocks := gomock.NewController(t)
+	defer mocks.Finish()
+
+	pub := mustParsePublicKey(t, dummyPublic)
+
+	cards := mock_pivcard.NewMockOpener(mocks)
+	cards.EXPECT().
+		List().
+		Return([]*pivcard.CardInfo{
+			{
+				Reader: "Yubico YubiKey OTP+FIDO+CCID 00 00",
+				Serial: dummySerial,
+				Keys: []*pivcard.KeyInfo{
+					{Slot: dummySlot, Name: "test", Public: pub},
+				},
+			},
+			{
+				Reader: "Yubico YubiKey OTP+FIDO+CCID 01 00",
+				Serial: 42,
+			},
+		}, nil)
+
+	got, err := pivplug.ListKeys(cards)
+	if err != nil {
+		t.Fatalf("pivplug.ListKeys: %v", err)
+	}
+	want := []*pivplug.CardKeys{
+		{
+			Reader: "Yubico YubiKey OTP+FIDO+CCID 00 00",
+			Serial: dummySerial,
+			Keys: []*pivplug.HardwareKey{
+				{
+					Serial:    dummySerial,
+					Slot:      dummySlot,
+					Name:      "test",
+					Recipient: dummyRecipient,
+					Identity:  dummyIdentity,
+				},
+			},
+		},
+		{
+			Reader: "Yubico YubiKey OTP+FIDO+CCID 01 00",
+			Serial: 42,
+		},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("wrong keys (-got +want)\n%s", diff)
+	}
+}
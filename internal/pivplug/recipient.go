@@ -1,18 +1,17 @@
 package pivplug
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
+	"context"
+	"crypto"
+	"crypto/ecdh"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
-	"strconv"
 
 	"eagain.net/go/bech32"
 	"eagain.net/go/yubage/internal/ageplugin"
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
 )
 
 func PublicKeyTagFromRecipient(recipient string) string {
@@ -22,8 +21,10 @@ func PublicKeyTagFromRecipient(recipient string) string {
 }
 
 type PIVRecipient struct {
+	// Compressed is the encoded public key: a compressed point, or
+	// the raw bytes of an X25519 key.
 	Compressed []byte
-	Public     *ecdsa.PublicKey
+	Public     crypto.PublicKey
 	Tag        string
 }
 
@@ -38,15 +39,13 @@ func ParsePIVRecipient(recipient string) (*PIVRecipient, error) {
 		return nil, errors.New("not a PIV recipient")
 	}
 
-	curve := elliptic.P256()
-	x, y := elliptic.UnmarshalCompressed(curve, compressed)
-	if x == nil {
-		return nil, errors.New("does not contain a compressed P-256 key")
+	kt, err := keyTypeForEncoded(compressed)
+	if err != nil {
+		return nil, err
 	}
-	pub := &ecdsa.PublicKey{
-		Curve: curve,
-		X:     x,
-		Y:     y,
+	pub, err := kt.parse(compressed)
+	if err != nil {
+		return nil, err
 	}
 	tag := PublicKeyTagFromRecipient(recipient)
 
@@ -62,110 +61,109 @@ func FormatPIVRecipient(compressed []byte) string {
 	s, err := bech32.Encode(recipientHRP, compressed)
 	if err != nil {
 		// input data is fixed length, this just can't happen
-		panic("Bech32 encode of ECDSA public key failed: " + err.Error())
+		panic("Bech32 encode of public key failed: " + err.Error())
 	}
 	return s
 }
 
-func Recipient(conn *ageplugin.Conn) error {
-	debugf("recipient plugin start")
-	defer debugf("recipient plugin stop")
+// WrapFileKey encrypts the file key to the recipient, returning the
+// age header stanza.
+func WrapFileKey(r *PIVRecipient, fileKey []byte) (*format.Stanza, error) {
+	kt, err := keyTypeForPublic(r.Public)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := ecdhPublic(r.Public)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := kt.newEphemeral()
+	if err != nil {
+		return nil, fmt.Errorf("generating ephemeral key failed: %v", err)
+	}
+	return wrapWithEphemeral(kt, eph, r, peer, fileKey)
+}
 
-	var (
-		// these contain nil items for anything unrecognized, because
-		// we have to use original indexes in responses
+// wrapWithEphemeral encrypts the file key to the recipient, with the
+// shared secret of eph and the recipient key.
+func wrapWithEphemeral(kt *keyType, eph *ephemeralKey, r *PIVRecipient, peer *ecdh.PublicKey, fileKey []byte) (*format.Stanza, error) {
+	sharedSecret, err := eph.private.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("%s key agreement failed: %v", kt, err)
+	}
+	wrappedKey, err := wrapKey(kt, sharedSecret, eph.encoded, r.Compressed, fileKey)
+	if err != nil {
+		return nil, fmt.Errorf("wrapping file key failed: %v", err)
+	}
+	stanza := &format.Stanza{
+		Type: kt.stanzaType,
+		Args: []string{r.Tag, base64.RawStdEncoding.EncodeToString(eph.encoded)},
+		Body: wrappedKey,
+	}
+	return stanza, nil
+}
 
-		recipients []string
-		fileKeys   [][]byte
-	)
+// recipientPlugin wraps file keys to Yubikey recipients.
+type recipientPlugin struct {
+	opts *Options
+}
 
-loop:
-	for {
-		stanza, err := conn.ReadStanza()
-		if err == io.EOF {
-			return nil
-		}
-		if err != nil {
-			return fmt.Errorf("read error: %v", err)
-		}
-		switch stanza.Type {
-		case "add-recipient":
-			// increase the count, no matter what
-			recipients = append(recipients, "")
-			if len(stanza.Args) != 1 {
-				continue
-			}
-			if len(stanza.Body) != 0 {
-				continue
-			}
-			recipients[len(recipients)-1] = stanza.Args[0]
-		case "wrap-file-key":
-			// increase the count, no matter what
-			fileKeys = append(fileKeys, nil)
-			if len(stanza.Args) != 0 {
-				continue
-			}
-			fileKeys[len(fileKeys)-1] = stanza.Body
-		case "done":
-			if len(stanza.Args) != 0 {
-				return errors.New("unexpected arguments in done stanza")
-			}
-			if len(stanza.Body) != 0 {
-				return errors.New("unexpected body in done stanza")
-			}
-			break loop
-		default:
-			// ignore it
-		}
-	}
+var _ ageplugin.BatchRecipientPlugin = recipientPlugin{}
 
-	for recipIdx, recip := range recipients {
-		recipIdxStr := strconv.Itoa(recipIdx)
+func (p recipientPlugin) ParseRecipient(recipient string) (ageplugin.Recipient, error) {
+	r, err := ParsePIVRecipient(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Yubikey recipient: %v", err)
+	}
+	if err := p.opts.CheckRecipient(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
-		pivRecipient, err := ParsePIVRecipient(recip)
-		if err != nil {
-			debugf("cannot parse as PIV recipient: %q: %v", recip, err)
-			_ = err
-			continue
+// WrapBatch implements ageplugin.BatchRecipientPlugin, with
+// WrapFileKeys.
+func (p recipientPlugin) WrapBatch(ctx context.Context, recipients []ageplugin.Recipient, fileKeys [][]byte) ([][]*ageplugin.Stanza, error) {
+	pivRecipients := make([]*PIVRecipient, len(recipients))
+	for i, r := range recipients {
+		pivRecipients[i] = r.(*PIVRecipient)
+	}
+	wrapped, err := WrapFileKeys(pivRecipients, fileKeys)
+	if err != nil {
+		return nil, err
+	}
+	result := make([][]*ageplugin.Stanza, len(wrapped))
+	for i, stanzas := range wrapped {
+		for _, s := range stanzas {
+			result[i] = append(result[i], &ageplugin.Stanza{
+				Type: s.Type,
+				Args: s.Args,
+				Body: s.Body,
+			})
 		}
+	}
+	return result, nil
+}
 
-		for keyIdx, fileKey := range fileKeys {
-			keyIdxStr := strconv.Itoa(keyIdx)
-
-			eph, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-			if err != nil {
-				if err := conn.WriteStanza(&ageplugin.Stanza{
-					Type: "error",
-					Args: []string{"recipient", recipIdxStr},
-					Body: []byte(fmt.Sprintf("generating ephemeral key failed: %v", err)),
-				}); err != nil {
-					return fmt.Errorf("writing wrap-file-key error response failed: %v", err)
-				}
-			}
-			ephCompressed := elliptic.MarshalCompressed(eph.Curve, eph.PublicKey.X, eph.PublicKey.Y)
-			ephCompressedStr := base64.RawStdEncoding.EncodeToString(ephCompressed)
-			// ECDH shared secret between ephemeral key and yubikey
-			sharedSecretNum, _ := eph.PublicKey.ScalarMult(pivRecipient.Public.X, pivRecipient.Public.Y, eph.D.Bytes())
-			sharedSecret := sharedSecretNum.Bytes()
-
-			wrappedKey, err := wrapKey(sharedSecret, ephCompressed, pivRecipient.Compressed, fileKey)
-			if err != nil {
-				return err
-			}
-
-			if err := conn.WriteStanza(&ageplugin.Stanza{
-				Type: "recipient-stanza",
-				Args: []string{keyIdxStr, "piv-p256", pivRecipient.Tag, ephCompressedStr},
-				Body: wrappedKey,
-			}); err != nil {
-				return fmt.Errorf("writing wrap-file-key response failed: %v", err)
-			}
-		}
+// Wrap implements ageplugin.Recipient.
+func (r *PIVRecipient) Wrap(ctx context.Context, fileKey []byte) (*ageplugin.Stanza, error) {
+	stanza, err := WrapFileKey(r, fileKey)
+	if err != nil {
+		return nil, err
 	}
-	if err := conn.WriteStanza(&ageplugin.Stanza{
-		Type: "done",
-	}); err != nil {
-		return fmt.Errorf("writing wrap-file-key response failed: %v", err)
+	s := &ageplugin.Stanza{
+		Type: stanza.Type,
+		Args: stanza.Args,
+		Body: stanza.Body,
 	}
-	return nil
+	return s, nil
+}
+
+// Recipient runs the recipient-v1 side of the plugin protocol. opts
+// may be nil.
+func Recipient(ctx context.Context, opts *Options, conn *ageplugin.Conn) error {
+	debugf("recipient plugin start")
+	defer debugf("recipient plugin stop")
+
+	return ageplugin.ServeRecipient(ctx, conn, recipientPlugin{opts: opts})
 }
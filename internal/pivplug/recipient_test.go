@@ -2,6 +2,7 @@ package pivplug_test
 
 import (
 	"bytes"
+	"context"
 	"regexp"
 	"testing"
 
@@ -24,9 +25,11 @@ func TestRecipientChatSimple(t *testing.T) {
 39MwXeehyuGJAvn2xYi48A
 -> done
 
+-> ok
+
 `[1:])
 	conn := ageplugin.New(in, out)
-	if err := pivplug.Recipient(conn); err != nil {
+	if err := pivplug.Recipient(context.Background(), nil, conn); err != nil {
 		t.Fatalf("pivplug.Recipient: %v", err)
 	}
 	if in.Len() != 0 {
@@ -44,3 +47,32 @@ $`[1:])
 		t.Errorf("unexpected output:\n%s", got)
 	}
 }
+
+func TestRecipientChatBadRecipient(t *testing.T) {
+	in := new(bytes.Buffer)
+	out := new(bytes.Buffer)
+	in.WriteString(`
+-> add-recipient age1yubikey1invalid
+
+-> wrap-file-key
+39MwXeehyuGJAvn2xYi48A
+-> done
+
+-> ok
+
+`[1:])
+	conn := ageplugin.New(in, out)
+	if err := pivplug.Recipient(context.Background(), nil, conn); err != nil {
+		t.Fatalf("pivplug.Recipient: %v", err)
+	}
+	want := regexp.MustCompile(`
+^-> error recipient 0
+(?:[A-Za-z0-9+/]{64}\n)*[A-Za-z0-9+/]{0,63}
+-> done
+
+$`[1:])
+	got := out.Bytes()
+	if !want.Match(got) {
+		t.Errorf("unexpected output:\n%s", got)
+	}
+}
@@ -0,0 +1,52 @@
+package pivplug
+
+import (
+	"errors"
+
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+)
+
+// Rewrap edits the recipient stanzas of an age header. Stanzas for
+// the recipients in remove are dropped, and the file key is wrapped
+// to the recipients in add that are not already present. Stanzas of
+// other types are kept as is.
+//
+// Removing a recipient does not revoke its access: the file key stays
+// the same, so anyone who saw the old header or the file key can still
+// decrypt. Only encrypting again with a new file key does that.
+func Rewrap(stanzas []*format.Stanza, fileKey []byte, add, remove []*PIVRecipient) ([]*format.Stanza, error) {
+	removeTags := make(map[string]struct{}, len(remove))
+	for _, r := range remove {
+		removeTags[r.Tag] = struct{}{}
+	}
+
+	var result []*format.Stanza
+	haveTags := make(map[string]struct{})
+	for _, s := range stanzas {
+		recip, err := parsePIVStanza(s.Type, s.Args, s.Body)
+		if err == nil {
+			if _, ok := removeTags[recip.Tag]; ok {
+				continue
+			}
+			haveTags[recip.Tag] = struct{}{}
+		}
+		result = append(result, s)
+	}
+
+	for _, r := range add {
+		if _, ok := haveTags[r.Tag]; ok {
+			continue
+		}
+		s, err := WrapFileKey(r, fileKey)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+		haveTags[r.Tag] = struct{}{}
+	}
+
+	if len(result) == 0 {
+		return nil, errors.New("no recipients left")
+	}
+	return result, nil
+}
@@ -0,0 +1,89 @@
+package pivplug_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"eagain.net/go/yubage/internal/pivplug"
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+)
+
+func mustNewRecipient(t *testing.T) *pivplug.PIVRecipient {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := elliptic.MarshalCompressed(key.Curve, key.PublicKey.X, key.PublicKey.Y)
+	r, err := pivplug.ParsePIVRecipient(pivplug.FormatPIVRecipient(compressed))
+	if err != nil {
+		t.Fatalf("ParsePIVRecipient: %v", err)
+	}
+	return r
+}
+
+func stanzaTags(stanzas []*format.Stanza) []string {
+	var tags []string
+	for _, s := range stanzas {
+		if s.Type != "piv-p256" {
+			tags = append(tags, s.Type)
+			continue
+		}
+		tags = append(tags, s.Args[0])
+	}
+	return tags
+}
+
+func TestRewrap(t *testing.T) {
+	fileKey := []byte("0123456789abcdef")
+	alice := mustNewRecipient(t)
+	bob := mustNewRecipient(t)
+	carol := mustNewRecipient(t)
+
+	var stanzas []*format.Stanza
+	for _, r := range []*pivplug.PIVRecipient{alice, bob} {
+		s, err := pivplug.WrapFileKey(r, fileKey)
+		if err != nil {
+			t.Fatalf("WrapFileKey: %v", err)
+		}
+		stanzas = append(stanzas, s)
+	}
+	noise := &format.Stanza{Type: "X25519", Args: []string{"noise"}, Body: []byte("noise")}
+	stanzas = append(stanzas, noise)
+
+	got, err := pivplug.Rewrap(stanzas, fileKey,
+		[]*pivplug.PIVRecipient{carol, alice},
+		[]*pivplug.PIVRecipient{bob},
+	)
+	if err != nil {
+		t.Fatalf("Rewrap: %v", err)
+	}
+	tags := stanzaTags(got)
+	want := []string{alice.Tag, "X25519", carol.Tag}
+	if len(tags) != len(want) {
+		t.Fatalf("wrong stanzas: %q != %q", tags, want)
+	}
+	for i := range want {
+		if tags[i] != want[i] {
+			t.Errorf("wrong stanzas: %q != %q", tags, want)
+			break
+		}
+	}
+	if got[0] != stanzas[0] {
+		t.Errorf("existing stanza was not kept as is")
+	}
+}
+
+func TestRewrapRemoveAll(t *testing.T) {
+	fileKey := []byte("0123456789abcdef")
+	alice := mustNewRecipient(t)
+	s, err := pivplug.WrapFileKey(alice, fileKey)
+	if err != nil {
+		t.Fatalf("WrapFileKey: %v", err)
+	}
+	if _, err := pivplug.Rewrap([]*format.Stanza{s}, fileKey, nil, []*pivplug.PIVRecipient{alice}); err == nil {
+		t.Error("expected error for removing all recipients")
+	}
+}
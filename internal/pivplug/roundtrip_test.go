@@ -0,0 +1,266 @@
+package pivplug_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"os"
+	"testing"
+
+	"eagain.net/go/yubage/internal/ageplugin"
+	"eagain.net/go/yubage/internal/pivcard"
+	"eagain.net/go/yubage/internal/pivplug"
+	"eagain.net/go/yubage/internal/third_party/ageinternal/format"
+	"github.com/golang/mock/gomock"
+)
+
+// pipePlugin runs fn as the plugin side of a connection over OS
+// pipes, returning the host side.
+func pipePlugin(t *testing.T, fn func(ctx context.Context, conn *ageplugin.Conn) error) (*ageplugin.Conn, <-chan error) {
+	t.Helper()
+	hostR, pluginW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pluginR, hostW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		hostR.Close()
+		hostW.Close()
+	})
+	errCh := make(chan error, 1)
+	go func() {
+		defer pluginR.Close()
+		defer pluginW.Close()
+		errCh <- fn(context.Background(), ageplugin.New(pluginR, pluginW))
+	}()
+	return ageplugin.New(hostR, hostW), errCh
+}
+
+// recipientFunc returns the recipient plugin, with opts, for
+// pipePlugin.
+func recipientFunc(opts *pivplug.Options) func(ctx context.Context, conn *ageplugin.Conn) error {
+	return func(ctx context.Context, conn *ageplugin.Conn) error {
+		return pivplug.Recipient(ctx, opts, conn)
+	}
+}
+
+func TestRoundtrip(t *testing.T) {
+	mocks := gomock.NewController(t)
+	defer mocks.Finish()
+
+	private := dummyPrivate(t)
+	fileKey := []byte("0123456789abcdef")
+
+	var messages []string
+	host := &ageplugin.Host{
+		RequestSecret: func(question string) (string, error) {
+			return "123456", nil
+		},
+		DisplayMessage: func(text string) error {
+			messages = append(messages, text)
+			return nil
+		},
+	}
+
+	conn, errCh := pipePlugin(t, recipientFunc(nil))
+	stanzas, pluginErrs, err := host.WrapConn(conn, []string{dummyRecipient}, [][]byte{fileKey})
+	if err != nil {
+		t.Fatalf("WrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Recipient: %v", err)
+	}
+	if len(pluginErrs) != 0 {
+		t.Fatalf("unexpected recipient errors: %v", pluginErrs)
+	}
+	if len(stanzas) != 1 {
+		t.Fatalf("wrong number of stanzas: %d", len(stanzas))
+	}
+
+	cards, theCard, _ := mockDummyCard(mocks)
+	theCard.EXPECT().
+		Public().
+		Return(private.Public())
+	expectSharedKey(theCard).
+		DoAndReturn(func(ctx context.Context, peer *ecdsa.PublicKey, prompt pivcard.Prompter, notify pivcard.Notifier) ([]byte, error) {
+			pin, err := prompt("PIN?")
+			if err != nil {
+				return nil, err
+			}
+			if pin != "123456" {
+				t.Errorf("wrong PIN: %q", pin)
+			}
+			if err := notify("touch me"); err != nil {
+				return nil, err
+			}
+			mult, _ := peer.ScalarMult(peer.X, peer.Y, private.D.Bytes())
+			return mult.FillBytes(make([]byte, 32)), nil
+		})
+	theCard.EXPECT().
+		Close()
+
+	conn, errCh = pipePlugin(t, func(ctx context.Context, conn *ageplugin.Conn) error {
+		return pivplug.Identity(ctx, cards, nil, conn)
+	})
+	fileKeys, pluginErrs, err := host.UnwrapConn(conn, []string{dummyIdentity}, stanzas)
+	if err != nil {
+		t.Fatalf("UnwrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Identity: %v", err)
+	}
+	if len(pluginErrs) != 0 {
+		t.Fatalf("unexpected identity errors: %v", pluginErrs)
+	}
+	if len(messages) != 1 || messages[0] != "touch me" {
+		t.Errorf("wrong messages: %q", messages)
+	}
+	if len(fileKeys) != 1 {
+		t.Fatalf("wrong number of file keys: %d", len(fileKeys))
+	}
+	if g, e := fileKeys[0].Key, fileKey; !bytes.Equal(g, e) {
+		t.Errorf("wrong file key: %x != %x", g, e)
+	}
+}
+
+func TestWrapUnwrapFileKey(t *testing.T) {
+	mocks := gomock.NewController(t)
+	defer mocks.Finish()
+
+	private := dummyPrivate(t)
+	recipient, err := pivplug.ParsePIVRecipient(dummyRecipient)
+	if err != nil {
+		t.Fatalf("ParsePIVRecipient: %v", err)
+	}
+	identity, err := pivplug.ParsePIVIdentity(dummyIdentity)
+	if err != nil {
+		t.Fatalf("ParsePIVIdentity: %v", err)
+	}
+	fileKey := []byte("0123456789abcdef")
+
+	stanza, err := pivplug.WrapFileKey(recipient, fileKey)
+	if err != nil {
+		t.Fatalf("WrapFileKey: %v", err)
+	}
+	if g, e := stanza.Type, "piv-p256"; g != e {
+		t.Errorf("wrong stanza type: %q != %q", g, e)
+	}
+
+	cards, theCard, _ := mockDummyCard(mocks)
+	theCard.EXPECT().
+		Public().
+		Return(private.Public())
+	expectSharedKey(theCard).
+		DoAndReturn(func(ctx context.Context, peer *ecdsa.PublicKey, prompt pivcard.Prompter, notify pivcard.Notifier) ([]byte, error) {
+			mult, _ := peer.ScalarMult(peer.X, peer.Y, private.D.Bytes())
+			return mult.FillBytes(make([]byte, 32)), nil
+		})
+	theCard.EXPECT().
+		Close()
+
+	noise := &format.Stanza{Type: "X25519", Args: []string{"noise"}, Body: []byte("noise")}
+	malformed := &format.Stanza{Type: "piv-p256", Args: []string{dummyTag}, Body: []byte("wrapped")}
+	prompt := func(string) (string, error) { return "123456", nil }
+	notify := func(string) error { return nil }
+	got, err := pivplug.UnwrapFileKey(context.Background(), cards, nil, []*pivplug.PIVIdentity{identity}, []*format.Stanza{noise, malformed, stanza}, prompt, notify)
+	if err != nil {
+		t.Fatalf("UnwrapFileKey: %v", err)
+	}
+	if !bytes.Equal(got, fileKey) {
+		t.Errorf("wrong file key: %x != %x", got, fileKey)
+	}
+}
+
+func TestIdentitySessionReusesCard(t *testing.T) {
+	mocks := gomock.NewController(t)
+	defer mocks.Finish()
+
+	private := dummyPrivate(t)
+	fileKeys := [][]byte{
+		[]byte("0123456789abcdef"),
+		[]byte("fedcba9876543210"),
+	}
+
+	questions := 0
+	host := &ageplugin.Host{
+		RequestSecret: func(question string) (string, error) {
+			questions++
+			return "123456", nil
+		},
+		DisplayMessage: func(text string) error {
+			return nil
+		},
+	}
+
+	conn, errCh := pipePlugin(t, recipientFunc(nil))
+	stanzas, pluginErrs, err := host.WrapConn(conn, []string{dummyRecipient}, fileKeys)
+	if err != nil {
+		t.Fatalf("WrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Recipient: %v", err)
+	}
+	if len(pluginErrs) != 0 {
+		t.Fatalf("unexpected recipient errors: %v", pluginErrs)
+	}
+	if len(stanzas) != 2 {
+		t.Fatalf("wrong number of stanzas: %d", len(stanzas))
+	}
+
+	// the card is opened and closed just once, for both stanzas
+	cards, theCard, _ := mockDummyCard(mocks)
+	theCard.EXPECT().
+		Public().
+		Return(private.Public()).
+		Times(2)
+	// like the PIN policy "once", the card asks for the PIN only
+	// while it stays open
+	verified := false
+	expectSharedKey(theCard).
+		DoAndReturn(func(ctx context.Context, peer *ecdsa.PublicKey, prompt pivcard.Prompter, notify pivcard.Notifier) ([]byte, error) {
+			if !verified {
+				pin, err := prompt("PIN?")
+				if err != nil {
+					return nil, err
+				}
+				if pin != "123456" {
+					t.Errorf("wrong PIN: %q", pin)
+				}
+				verified = true
+			}
+			mult, _ := peer.ScalarMult(peer.X, peer.Y, private.D.Bytes())
+			return mult.FillBytes(make([]byte, 32)), nil
+		}).
+		Times(2)
+	theCard.EXPECT().
+		Close()
+
+	conn, errCh = pipePlugin(t, func(ctx context.Context, conn *ageplugin.Conn) error {
+		return pivplug.Identity(ctx, cards, nil, conn)
+	})
+	// the same identity twice must not open the card twice either
+	got, pluginErrs, err := host.UnwrapConn(conn, []string{dummyIdentity, dummyIdentity}, stanzas)
+	if err != nil {
+		t.Fatalf("UnwrapConn: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("pivplug.Identity: %v", err)
+	}
+	if len(pluginErrs) != 0 {
+		t.Fatalf("unexpected identity errors: %v", pluginErrs)
+	}
+	if questions != 1 {
+		t.Errorf("PIN was asked %d times", questions)
+	}
+	if len(got) != 2 {
+		t.Fatalf("wrong number of file keys: %d", len(got))
+	}
+	for _, fk := range got {
+		if g, e := fk.Key, fileKeys[fk.FileKeyIndex]; !bytes.Equal(g, e) {
+			t.Errorf("wrong file key %d: %x != %x", fk.FileKeyIndex, g, e)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package pivplug
+
+import (
+	"context"
+	"errors"
+
+	"eagain.net/go/yubage/internal/pivcard"
+)
+
+// Options adjust how cards are used for decryption, and which
+// recipients are accepted for encryption.
+type Options struct {
+	// NoPINCache makes every PIN use prompt for it, by closing the
+	// card after each use. Otherwise the card remembers the PIN
+	// for the rest of the session if its PIN policy is "once". The
+	// PIN is never remembered by the plugin itself.
+	NoPINCache bool
+	// Bundles are recipient bundles that passed Bundle.Verify.
+	Bundles []*Bundle
+	// RequireAttestation refuses recipients that are not in
+	// Bundles.
+	RequireAttestation bool
+}
+
+type cardKey struct {
+	serial uint32
+	slot   uint8
+}
+
+type sessionCard struct {
+	card pivcard.Card
+	err  error
+	// noCache closes the card after each use, so the card forgets
+	// the PIN even with the PIN policy "once"
+	noCache bool
+}
+
+// cardSession opens each card at most once, and keeps it open until
+// Close, unless NoPINCache is set.
+type cardSession struct {
+	opener pivcard.Opener
+	opts   Options
+	cards  map[cardKey]*sessionCard
+}
+
+// newCardSession starts a session. opts may be nil.
+func newCardSession(opener pivcard.Opener, opts *Options) *cardSession {
+	s := &cardSession{
+		opener: opener,
+		cards:  make(map[cardKey]*sessionCard),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	return s
+}
+
+func (s *cardSession) open(serial uint32, slot uint8) (*sessionCard, error) {
+	key := cardKey{serial: serial, slot: slot}
+	c, ok := s.cards[key]
+	if !ok || (c.card == nil && c.err == nil) {
+		debugf("opening Yubikey %d slot %02x", serial, slot)
+		card, err := s.opener.Open(serial, slot)
+		c = &sessionCard{
+			card:    card,
+			err:     err,
+			noCache: s.opts.NoPINCache,
+		}
+		s.cards[key] = c
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c, nil
+}
+
+// Close closes all the cards opened in the session.
+func (s *cardSession) Close() {
+	for key, c := range s.cards {
+		if c.card != nil {
+			if err := c.card.Close(); err != nil {
+				debugf("error closing card: %v", err)
+				_ = err
+			}
+		}
+		delete(s.cards, key)
+	}
+}
+
+// sharedKey does ECDH with the card. After a wrong PIN, it asks
+// again, unless only one attempt is left, or the same wrong PIN is
+// given again, so a script feeding a fixed PIN does not block the
+// card.
+func (c *sessionCard) sharedKey(ctx context.Context, recip *pivRecipientStanza, prompt pivcard.Prompter, notify pivcard.Notifier) ([]byte, error) {
+	if c.noCache {
+		defer c.close()
+	}
+	rejected := make(map[string]bool)
+	var lastPINErr *pivcard.PINError
+	for {
+		var entered string
+		repeated := false
+		checkingPrompt := func(msg string) (string, error) {
+			pin, err := prompt(msg)
+			if err != nil {
+				return "", err
+			}
+			if rejected[pin] {
+				repeated = true
+				return "", errors.New("same wrong PIN entered again")
+			}
+			entered = pin
+			return pin, nil
+		}
+		shared, err := c.card.SharedKey(ctx, recip.EphPublic, checkingPrompt, notify)
+		if err == nil {
+			return shared, nil
+		}
+		if repeated {
+			return nil, lastPINErr
+		}
+
+		var pinErr *pivcard.PINError
+		if !errors.As(err, &pinErr) {
+			return nil, err
+		}
+		if entered == "" || pinErr.Retries <= 1 {
+			return nil, err
+		}
+		rejected[entered] = true
+		lastPINErr = pinErr
+		debugf("wrong PIN, %d attempts left, asking again", pinErr.Retries)
+	}
+}
+
+// close closes the card, to be opened again on next use.
+func (c *sessionCard) close() {
+	if err := c.card.Close(); err != nil {
+		debugf("error closing card: %v", err)
+	}
+	c.card = nil
+}
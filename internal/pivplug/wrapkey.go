@@ -13,16 +13,15 @@ import (
 // https://age-encryption.org/v1 just like X25519
 //
 // salt is ephemeral public key || public key,
-// and label is "age-encryption.org/v1/piv-p256".
+// and label is "age-encryption.org/v1/piv-p256", or piv-p384 for
+// P-384 keys.
 
-const wrapLabel = "age-encryption.org/v1/piv-p256"
-
-func wrapKey(sharedSecret []byte, ephCompressed, pivCompressed []byte, key []byte) ([]byte, error) {
+func wrapKey(kt *keyType, sharedSecret []byte, ephCompressed, pivCompressed []byte, key []byte) ([]byte, error) {
 	salt := make([]byte, 0, len(ephCompressed)+len(pivCompressed))
 	salt = append(salt, ephCompressed...)
 	salt = append(salt, pivCompressed...)
 
-	h := hkdf.New(sha256.New, sharedSecret, salt, []byte(wrapLabel))
+	h := hkdf.New(sha256.New, sharedSecret, salt, []byte(kt.wrapLabel))
 	wrappingKey := make([]byte, chacha20poly1305.KeySize)
 	if _, err := io.ReadFull(h, wrappingKey); err != nil {
 		return nil, err
@@ -36,12 +35,12 @@ func wrapKey(sharedSecret []byte, ephCompressed, pivCompressed []byte, key []byt
 	return wrappedKey, nil
 }
 
-func unwrapKey(sharedSecret []byte, ephCompressed, pivCompressed []byte, wrappedKey []byte) ([]byte, error) {
+func unwrapKey(kt *keyType, sharedSecret []byte, ephCompressed, pivCompressed []byte, wrappedKey []byte) ([]byte, error) {
 	salt := make([]byte, 0, len(ephCompressed)+len(pivCompressed))
 	salt = append(salt, ephCompressed...)
 	salt = append(salt, pivCompressed...)
 
-	h := hkdf.New(sha256.New, sharedSecret, salt, []byte(wrapLabel))
+	h := hkdf.New(sha256.New, sharedSecret, salt, []byte(kt.wrapLabel))
 	wrappingKey := make([]byte, chacha20poly1305.KeySize)
 	if _, err := io.ReadFull(h, wrappingKey); err != nil {
 		return nil, err